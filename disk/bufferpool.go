@@ -0,0 +1,110 @@
+package disk
+
+import (
+	"container/list"
+	"sync"
+)
+
+const m_DEFAULT_BUFFER_POOL_SIZE = 256
+
+// Keeps the most recently used nodes decoded in memory, so that reading them again,
+// e.g. the upper levels of the tree, doesn't go to the file.
+// Nodes are handed out as copies, so evicting a node that an operation is still
+// using only means it has to be read again.
+type bufferPool struct {
+	mu       sync.Mutex
+	capacity int
+	// Most recently used at the front.
+	lru    *list.List
+	pages  map[uint64]*list.Element
+	hits   uint64
+	misses uint64
+}
+
+type bufferPoolEntry struct {
+	ptr  uint64
+	node *DiskBTreeNode
+}
+
+type BufferPoolStats struct {
+	// The number of node reads served from memory.
+	Hits uint64
+	// The number of node reads that had to go to the file.
+	Misses uint64
+}
+
+func newBufferPool(capacity int) *bufferPool {
+	return &bufferPool{
+		capacity: capacity,
+		lru:      list.New(),
+		pages:    make(map[uint64]*list.Element),
+	}
+}
+
+// Returns the cached node at `ptr`.
+func (p *bufferPool) get(ptr uint64) (*DiskBTreeNode, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elem, ok := p.pages[ptr]
+	if !ok {
+		p.misses++
+		return nil, false
+	}
+
+	p.hits++
+	p.lru.MoveToFront(elem)
+	return elem.Value.(*bufferPoolEntry).node, true
+}
+
+// Caches `node` at `ptr`.
+func (p *bufferPool) put(ptr uint64, node *DiskBTreeNode) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elem, ok := p.pages[ptr]
+	if ok {
+		p.lru.MoveToFront(elem)
+		elem.Value.(*bufferPoolEntry).node = node
+	} else {
+		elem = p.lru.PushFront(&bufferPoolEntry{ptr: ptr, node: node})
+		p.pages[ptr] = elem
+	}
+
+	p.evict()
+}
+
+func (p *bufferPool) remove(ptr uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elem, ok := p.pages[ptr]
+	if !ok {
+		return
+	}
+
+	p.lru.Remove(elem)
+	delete(p.pages, ptr)
+}
+
+func (p *bufferPool) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lru.Init()
+	p.pages = make(map[uint64]*list.Element)
+}
+
+// Removes the least recently used nodes until the pool is within its capacity.
+func (p *bufferPool) evict() {
+	for p.lru.Len() > p.capacity {
+		elem := p.lru.Back()
+		p.lru.Remove(elem)
+		delete(p.pages, elem.Value.(*bufferPoolEntry).ptr)
+	}
+}
+
+func (t *DiskBTree) BufferPoolStats() BufferPoolStats {
+	t.bufferPool.mu.Lock()
+	defer t.bufferPool.mu.Unlock()
+	return BufferPoolStats{
+		Hits:   t.bufferPool.hits,
+		Misses: t.bufferPool.misses,
+	}
+}
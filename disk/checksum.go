@@ -0,0 +1,39 @@
+package disk
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Unencrypted pages store a CRC32C checksum of the page data and the page pointer
+// right after the page data, in the space encrypted pages use for the IV and auth tag.
+
+const m_CHECKSUM_SIZE = 4
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+func pageChecksum(data []byte, ptr uint64) uint32 {
+	ptrBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(ptrBytes, ptr)
+	checksum := crc32.Checksum(data, castagnoliTable)
+
+	return crc32.Update(checksum, castagnoliTable, ptrBytes)
+}
+
+// Writes the checksum of the first `dataSize` bytes of `pageBytes` after them.
+func addChecksum(pageBytes []byte, dataSize int, ptr uint64) []byte {
+	checksum := pageChecksum(pageBytes[:dataSize], ptr)
+	binary.BigEndian.PutUint32(pageBytes[dataSize:dataSize+m_CHECKSUM_SIZE], checksum)
+
+	return pageBytes
+}
+
+// Returns the page data if its checksum matches, otherwise an *ErrCorruptPage.
+func verifyChecksum(pageBytes []byte, dataSize int, ptr uint64) ([]byte, error) {
+	checksum := binary.BigEndian.Uint32(pageBytes[dataSize : dataSize+m_CHECKSUM_SIZE])
+	if checksum != pageChecksum(pageBytes[:dataSize], ptr) {
+		return nil, &ErrCorruptPage{Ptr: ptr}
+	}
+
+	return pageBytes[:dataSize], nil
+}
@@ -0,0 +1,251 @@
+package disk
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+)
+
+// With a compressor, leaves can take up more than a page as long as they fit in one
+// once they're compressed. Such leaves are encoded as if pages were up to four times
+// larger and their slots and cells are compressed. Leaves that fit in a page as they
+// are, and all non leaf nodes, are written uncompressed.
+//
+// Compressed leaf pages are laid out as the node header, 1b codec, 2b length, compressed
+// slots and cells. The header is stored uncompressed with m_COMPRESSED_LEAF_PAGE as its
+// page type, so that changing the pointers of a leaf to other nodes doesn't change its size.
+// The codec is the ID of the compressor, so pages written with DeflateCompressor can
+// always be read, and other pages only with the compressor that wrote them.
+
+const m_COMPRESSED_PAGE_HEADER_SIZE = m_NODE_HEADER_SIZE + 3
+
+// The number of compressed leaves that are remembered, so that a leaf that was checked
+// to fit isn't compressed again when it's written. Splits check two leaves at a time.
+const m_COMPRESSION_CACHE_SIZE = 4
+
+// Codec 0 means a tree or a page isn't compressed.
+const m_NO_CODEC = 0
+const m_DEFLATE_CODEC = 1
+
+// Compresses leaves that don't fit in a page otherwise.
+type Compressor interface {
+	// Identifies the codec in the header of compressed pages. 0 means uncompressed
+	// and 1 is DeflateCompressor, so other compressors need other IDs.
+	ID() uint8
+	Compress(b []byte) ([]byte, error)
+	Decompress(b []byte) ([]byte, error)
+}
+
+// Compresses pages with DEFLATE from compress/flate.
+type DeflateCompressor struct {
+	// A compress/flate compression level. Zero means flate.DefaultCompression.
+	Level int
+}
+
+func (c DeflateCompressor) ID() uint8 {
+	return m_DEFLATE_CODEC
+}
+
+func (c DeflateCompressor) Compress(b []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(b)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c DeflateCompressor) Decompress(b []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// The page size leaves are encoded with before they're compressed.
+func (t *DiskBTree) compressedLeafPageSize() int {
+	return min(4*t.pageSize, m_MAX_PAGE_SIZE)
+}
+
+// Reports whether a node with `numKeys` keys taking up `payloadSize` bytes might fit
+// in a page. It's exact for nodes that aren't compressed. Leaves of trees with a
+// compressor might fit if they're small enough to be compressed.
+func (t *DiskBTree) mightFit(isLeaf bool, numKeys uint16, payloadSize int) bool {
+	if !isLeaf || t.compressor == nil {
+		return t.nodeFits(numKeys, payloadSize)
+	}
+
+	if t.order != 0 && numKeys > t.order-1 {
+		return false
+	}
+
+	return m_NODE_HEADER_SIZE+payloadSize <= t.compressedLeafPageSize()-m_GCM_IV_SIZE-m_GCM_AUTH_SIZE
+}
+
+// Reports whether `leaf` fits in a page once it's compressed. Removing entries from
+// a leaf can make it compress worse, so it has to fit with some room to spare to
+// avoid splitting it again right away.
+func (t *DiskBTree) fitsCompressed(leaf *DiskBTreeNode) bool {
+	if !t.mightFit(true, leaf.Numkeys, t.payloadSize(leaf)) {
+		return false
+	}
+
+	_, compressed, err := t.compressLeaf(leaf)
+	slack := t.pageDataSize() / 16
+	return err == nil && m_COMPRESSED_PAGE_HEADER_SIZE+len(compressed) <= t.pageDataSize()-slack
+}
+
+// Reports whether `node` can be split at `splitIdx` into two nodes that fit in a page.
+// Only compressed leaves need to be checked, since the sizes of the others are known.
+func (t *DiskBTree) canSplitAt(node *DiskBTreeNode, splitIdx uint16) bool {
+	if !node.IsLeaf || t.compressor == nil {
+		return true
+	}
+
+	return t.fits(subLeaf(node, 0, splitIdx)) && t.fits(subLeaf(node, splitIdx, node.Numkeys))
+}
+
+// Returns a leaf that holds the entries of `leaf` from `start` up to `end`.
+func subLeaf(leaf *DiskBTreeNode, start, end uint16) *DiskBTreeNode {
+	return &DiskBTreeNode{
+		IsLeaf:   true,
+		Numkeys:  end - start,
+		Keys:     leaf.Keys[start:end],
+		Pointers: leaf.Pointers[start:end],
+	}
+}
+
+// Returns a leaf that holds the entries of both `leaf` and `sibling`.
+func mergedLeaf(leaf, sibling *DiskBTreeNode) *DiskBTreeNode {
+	if leaf.Numkeys > 0 && sibling.Numkeys > 0 && bytes.Compare(sibling.Keys[0], leaf.Keys[0]) < 0 {
+		leaf, sibling = sibling, leaf
+	}
+
+	merged := &DiskBTreeNode{IsLeaf: true, Numkeys: leaf.Numkeys + sibling.Numkeys}
+	merged.Keys = append(append([][]byte(nil), leaf.Keys[:leaf.Numkeys]...), sibling.Keys[:sibling.Numkeys]...)
+	merged.Pointers = append(append([]interface{}(nil), leaf.Pointers[:leaf.Numkeys]...), sibling.Pointers[:sibling.Numkeys]...)
+
+	return merged
+}
+
+// Returns the bytes `node` is written as. Leaves that don't fit in a page are compressed.
+func (t *DiskBTree) encodeNode(node *DiskBTreeNode) ([]byte, error) {
+	if !node.IsLeaf || t.compressor == nil || t.nodeFits(node.Numkeys, t.payloadSize(node)) {
+		return node.toBytes(t.pageSize, t.nodePrefixLength(node)), nil
+	}
+
+	nodeBytes, compressed, err := t.compressLeaf(node)
+	if err != nil {
+		return nil, err
+	}
+
+	if m_COMPRESSED_PAGE_HEADER_SIZE+len(compressed) > t.pageDataSize() {
+		return nil, PAGE_OVERFLOW_ERROR
+	}
+
+	pageBytes := make([]byte, t.pageSize)
+	copy(pageBytes, nodeBytes[:m_NODE_HEADER_SIZE])
+	pageBytes[0] = m_COMPRESSED_LEAF_PAGE
+	pageBytes[m_NODE_HEADER_SIZE] = t.compressor.ID()
+	binary.BigEndian.PutUint16(pageBytes[m_NODE_HEADER_SIZE+1:m_COMPRESSED_PAGE_HEADER_SIZE], uint16(len(compressed)))
+	copy(pageBytes[m_COMPRESSED_PAGE_HEADER_SIZE:], compressed)
+
+	return pageBytes, nil
+}
+
+// Returns the encoding of `leaf` and its compressed slots and cells.
+func (t *DiskBTree) compressLeaf(leaf *DiskBTreeNode) ([]byte, []byte, error) {
+	nodeBytes := leaf.toBytes(t.compressedLeafPageSize(), t.nodePrefixLength(leaf))
+	body := nodeBytes[m_NODE_HEADER_SIZE:]
+	for _, cached := range t.compressionCache {
+		if bytes.Equal(cached.body, body) {
+			return nodeBytes, cached.compressed, nil
+		}
+	}
+
+	compressed, err := t.compressor.Compress(body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(t.compressionCache) == m_COMPRESSION_CACHE_SIZE {
+		t.compressionCache = t.compressionCache[1:]
+	}
+
+	t.compressionCache = append(t.compressionCache, compressedLeaf{body: body, compressed: compressed})
+
+	return nodeBytes, compressed, nil
+}
+
+type compressedLeaf struct {
+	body       []byte
+	compressed []byte
+}
+
+// Returns the leaf encoding stored in a compressed leaf page.
+func (t *DiskBTree) decompressLeaf(pageBytes []byte) ([]byte, error) {
+	compressor, err := t.codec(pageBytes[m_NODE_HEADER_SIZE])
+	if err != nil {
+		return nil, err
+	}
+
+	end := m_COMPRESSED_PAGE_HEADER_SIZE + int(binary.BigEndian.Uint16(pageBytes[m_NODE_HEADER_SIZE+1:m_COMPRESSED_PAGE_HEADER_SIZE]))
+	if end > len(pageBytes) {
+		return nil, INVALID_PAGE_TYPE_ERROR
+	}
+
+	body, err := compressor.Decompress(pageBytes[m_COMPRESSED_PAGE_HEADER_SIZE:end])
+	if err != nil {
+		return nil, err
+	}
+
+	if m_NODE_HEADER_SIZE+len(body) != t.compressedLeafPageSize() {
+		return nil, INVALID_PAGE_TYPE_ERROR
+	}
+
+	nodeBytes := make([]byte, t.compressedLeafPageSize())
+	copy(nodeBytes, pageBytes[:m_NODE_HEADER_SIZE])
+	nodeBytes[0] = m_LEAF_PAGE
+	copy(nodeBytes[m_NODE_HEADER_SIZE:], body)
+
+	return nodeBytes, nil
+}
+
+// Returns the compressor of the codec with `id`.
+func (t *DiskBTree) codec(id uint8) (Compressor, error) {
+	if t.compressor != nil && t.compressor.ID() == id {
+		return t.compressor, nil
+	}
+
+	if id == m_DEFLATE_CODEC {
+		return DeflateCompressor{}, nil
+	}
+
+	return nil, UNKNOWN_CODEC_ERROR
+}
+
+// Returns the ID of the compressor of the tree, or m_NO_CODEC if it has none.
+func (t *DiskBTree) codecID() uint8 {
+	if t.compressor == nil {
+		return m_NO_CODEC
+	}
+
+	return t.compressor.ID()
+}
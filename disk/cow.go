@@ -0,0 +1,288 @@
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+)
+
+// In copy-on-write mode, pointers stored in the tree are logical. A page table maps every
+// logical page to the physical page in the file that currently holds it. Pages changed by
+// an operation are never overwritten. They are written to free physical pages instead and
+// the table is updated to point to them. The new version of the tree only becomes visible
+// when the master page is written with the new table, so a crash at any point before that
+// leaves the previous version intact without needing a log.
+//
+// The table is split into table pages of 1b pageType followed by physical ptrs. The table
+// pages are listed in directory pages with the same layout, and the master page lists the
+// directory pages. Changing an entry only rewrites its table page and directory page.
+//
+// The physical pages of the previous version are reclaimed as soon as the new version is
+// published, since all reads go through the latest table.
+
+const m_TABLE_PAGE = 4
+
+// The copy-on-write part of the master page starts after the fixed fields.
+// 1b flags, 8b physicalPageCount, 2b tableDirSize, tableDirSize * 8b ptrs
+const m_MASTER_PAGE_COW_OFFSET = 64
+const m_MASTER_PAGE_COW_HEADER_SIZE = 11
+const m_MAX_TABLE_DIR_SIZE = (m_MASTER_PAGE_DATA_SIZE - m_MASTER_PAGE_COW_OFFSET - m_MASTER_PAGE_COW_HEADER_SIZE) / 8
+
+const m_COPY_ON_WRITE_FLAG = 1
+
+// Returns the number of ptrs a table or directory page can hold.
+func (t *DiskBTree) tableEntriesPerPage() int {
+	return (t.pageDataSize() - 1) / 8
+}
+
+func (t *DiskBTree) pageIndex(ptr uint64) int {
+	return int((ptr - m_DATA_OFFSET) / uint64(t.pageSize))
+}
+
+// Returns the physical page that holds the logical page at `ptr`.
+func (t *DiskBTree) physicalPtr(ptr uint64) (uint64, error) {
+	idx := t.pageIndex(ptr)
+	if idx >= len(t.pageTable) || t.pageTable[idx] == 0 {
+		return 0, errors.New("Page is not mapped")
+	}
+
+	return t.pageTable[idx], nil
+}
+
+// Returns a physical page that isn't used by the current version of the tree.
+func (t *DiskBTree) allocatePhysicalPage() uint64 {
+	if len(t.freePhysicalPages) > 0 {
+		ptr := t.freePhysicalPages[len(t.freePhysicalPages)-1]
+		t.freePhysicalPages = t.freePhysicalPages[:len(t.freePhysicalPages)-1]
+		return ptr
+	}
+
+	ptr := m_DATA_OFFSET + t.masterPage.physicalPageCount*uint64(t.pageSize)
+	t.masterPage.physicalPageCount++
+
+	return ptr
+}
+
+// Forgets the page table, e.g. after the file was emptied.
+func (t *DiskBTree) resetPageTable() {
+	t.pageTable = nil
+	t.tablePages = nil
+	t.freePhysicalPages = nil
+	t.releasedPhysicalPages = nil
+}
+
+// Reads the page table of the current master page and works out which physical pages are free.
+func (t *DiskBTree) loadPageTable() error {
+	t.resetPageTable()
+	mp := t.masterPage
+	tablePages, err := t.readTablePages(mp.tableDir, 0)
+	if err != nil {
+		return err
+	}
+
+	numTablePages := (int(mp.pageCount) + t.tableEntriesPerPage() - 1) / t.tableEntriesPerPage()
+	if len(tablePages) < numTablePages {
+		return INVALID_FILE_ERROR
+	}
+
+	t.tablePages = tablePages[:numTablePages]
+	t.pageTable, err = t.readTablePages(t.tablePages, int(mp.pageCount))
+	if err != nil {
+		return err
+	}
+
+	t.pageTable = t.pageTable[:mp.pageCount]
+	used := make([]bool, mp.physicalPageCount)
+	markUsed := func(ptrs []uint64) error {
+		for _, ptr := range ptrs {
+			if ptr == 0 {
+				continue
+			}
+
+			if !mp.isValidPhysicalPtr(ptr) {
+				return INVALID_FILE_ERROR
+			}
+
+			used[t.pageIndex(ptr)] = true
+		}
+
+		return nil
+	}
+
+	for _, ptrs := range [][]uint64{mp.tableDir, t.tablePages, t.pageTable} {
+		err = markUsed(ptrs)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Free pages are taken from the end, so the ones at the start of the file are reused first.
+	for i := len(used) - 1; i >= 0; i-- {
+		if !used[i] {
+			t.freePhysicalPages = append(t.freePhysicalPages, m_DATA_OFFSET+uint64(i)*uint64(t.pageSize))
+		}
+	}
+
+	return nil
+}
+
+// Reads the ptrs stored in the table or directory pages at `ptrs`. It reads at least `minLength`
+// ptrs, which may be 0 if the pages aren't full.
+func (t *DiskBTree) readTablePages(ptrs []uint64, minLength int) ([]uint64, error) {
+	perPage := t.tableEntriesPerPage()
+	entries := make([]uint64, 0, max(len(ptrs)*perPage, minLength))
+	for _, ptr := range ptrs {
+		if !t.masterPage.isValidPhysicalPtr(ptr) {
+			return nil, INVALID_FILE_ERROR
+		}
+
+		pageBytes, err := t.readFilePage(ptr)
+		if err != nil {
+			return nil, err
+		}
+
+		pageBytes, err = t.openPage(pageBytes, t.pageDataSize(), ptr)
+		if err != nil {
+			return nil, err
+		}
+
+		if pageBytes[0] != m_TABLE_PAGE {
+			return nil, INVALID_PAGE_TYPE_ERROR
+		}
+
+		for i := 0; i < perPage; i++ {
+			entries = append(entries, binary.BigEndian.Uint64(pageBytes[1+i*8:9+i*8]))
+		}
+	}
+
+	for len(entries) < minLength {
+		entries = append(entries, 0)
+	}
+
+	return entries, nil
+}
+
+// Writes the table or directory pages in `dirty` to new physical pages. `pages` holds the
+// current physical pages, and the updated list is returned.
+func (t *DiskBTree) writeTablePages(entries []uint64, pages []uint64, dirty map[int]bool) ([]uint64, error) {
+	perPage := t.tableEntriesPerPage()
+	for _, i := range sortedIndexes(dirty) {
+		pageBytes := make([]byte, t.pageSize)
+		pageBytes[0] = m_TABLE_PAGE
+		for j, entry := range entries[i*perPage : min((i+1)*perPage, len(entries))] {
+			binary.BigEndian.PutUint64(pageBytes[1+j*8:9+j*8], entry)
+		}
+
+		ptr := t.allocatePhysicalPage()
+		sealedBytes, err := t.sealPage(pageBytes, t.pageDataSize(), ptr)
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeAt(t.dbFile, sealedBytes, int64(ptr))
+		if err != nil {
+			return nil, err
+		}
+
+		if i < len(pages) {
+			t.releasedPhysicalPages = append(t.releasedPhysicalPages, pages[i])
+			pages[i] = ptr
+		} else {
+			pages = append(pages, ptr)
+		}
+	}
+
+	return pages, nil
+}
+
+// Writes the pending pages to free physical pages and publishes them with a new master page.
+func (t *DiskBTree) commitCopyOnWrite() error {
+	perPage := t.tableEntriesPerPage()
+	for len(t.pageTable) < int(t.masterPage.pageCount) {
+		t.pageTable = append(t.pageTable, 0)
+	}
+
+	dirtyTablePages := make(map[int]bool)
+	for _, ptr := range sortedKeys(t.pendingPages) {
+		if ptr < m_DATA_OFFSET {
+			continue
+		}
+
+		idx := t.pageIndex(ptr)
+		physicalPtr := t.allocatePhysicalPage()
+		err := writeAt(t.dbFile, t.pendingPages[ptr], int64(physicalPtr))
+		if err != nil {
+			return err
+		}
+
+		if t.pageTable[idx] != 0 {
+			t.releasedPhysicalPages = append(t.releasedPhysicalPages, t.pageTable[idx])
+		}
+
+		t.pageTable[idx] = physicalPtr
+		dirtyTablePages[idx/perPage] = true
+	}
+
+	dirtyDirPages := make(map[int]bool)
+	for i := range dirtyTablePages {
+		dirtyDirPages[i/perPage] = true
+	}
+
+	var err error
+	t.tablePages, err = t.writeTablePages(t.pageTable, t.tablePages, dirtyTablePages)
+	if err != nil {
+		return err
+	}
+
+	tableDir, err := t.writeTablePages(t.tablePages, append([]uint64(nil), t.masterPage.tableDir...), dirtyDirPages)
+	if err != nil {
+		return err
+	}
+
+	if len(tableDir) > m_MAX_TABLE_DIR_SIZE {
+		return TREE_TOO_LARGE_ERROR
+	}
+
+	// Everything the new master page points to must be on disk before it is.
+	err = t.syncFile(t.dbFile)
+	if err != nil {
+		return err
+	}
+
+	t.masterPage.tableDir = tableDir
+	masterpageBytes, slot, err := t.sealMasterPage()
+	if err != nil {
+		return err
+	}
+
+	err = writeAt(t.dbFile, masterpageBytes, int64(slot))
+	if err != nil {
+		return err
+	}
+
+	err = t.syncFile(t.dbFile)
+	if err != nil {
+		return err
+	}
+
+	t.masterPage.sequence++
+	t.lastSync = time.Now()
+
+	t.pendingPages = make(map[uint64][]byte)
+	t.freePhysicalPages = append(t.freePhysicalPages, t.releasedPhysicalPages...)
+	t.releasedPhysicalPages = nil
+
+	return nil
+}
+
+func sortedIndexes(indexes map[int]bool) []int {
+	sorted := make([]int, 0, len(indexes))
+	for i := range indexes {
+		sorted = append(sorted, i)
+	}
+
+	sort.Ints(sorted)
+
+	return sorted
+}
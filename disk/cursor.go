@@ -0,0 +1,254 @@
+package disk
+
+import "bytes"
+
+// Walks the entries of a tree in key order by following the links between leaves.
+// A cursor starts out invalid. It's positioned with First, Last or Seek and moved with
+// Next and Prev. Changes made to the tree after a move are seen by the next move,
+// which continues from the key the cursor is at.
+//
+// A cursor becomes invalid when reading a page fails. Err returns the error in that case.
+// Cursors can be used concurrently with other cursors and operations on the tree, but
+// a cursor itself must not be used by more than one goroutine at a time.
+type Cursor struct {
+	tree *DiskBTree
+	leaf *DiskBTreeNode
+	idx  int
+	// The number of changes to the tree when the cursor was positioned.
+	changes uint64
+	key     []byte
+	value   []byte
+	err     error
+}
+
+// Returns a new cursor over the entries of the tree.
+func (t *DiskBTree) Cursor() *Cursor {
+	return &Cursor{tree: t}
+}
+
+// Moves to the first entry of the tree. Returns false if the tree is empty.
+func (c *Cursor) First() bool {
+	c.tree.mu.RLock()
+	defer c.tree.mu.RUnlock()
+	c.err = nil
+
+	leaf, err := c.tree.edgeLeaf(false)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	return c.forward(leaf, 0)
+}
+
+// Moves to the last entry of the tree. Returns false if the tree is empty.
+func (c *Cursor) Last() bool {
+	c.tree.mu.RLock()
+	defer c.tree.mu.RUnlock()
+	c.err = nil
+
+	leaf, err := c.tree.edgeLeaf(true)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if leaf == nil {
+		return c.set(nil, 0)
+	}
+
+	return c.backward(leaf, int(leaf.Numkeys)-1)
+}
+
+// Moves to the first entry whose key is greater than or equal to `key`.
+// Returns false if there is no such entry.
+func (c *Cursor) Seek(key []byte) bool {
+	c.tree.mu.RLock()
+	defer c.tree.mu.RUnlock()
+	c.err = nil
+
+	leaf, idx, err := c.tree.seek(key)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	return c.forward(leaf, idx)
+}
+
+// Moves to the next entry. Returns false if the cursor was at the last entry or invalid.
+func (c *Cursor) Next() bool {
+	if c.leaf == nil {
+		return false
+	}
+
+	c.tree.mu.RLock()
+	defer c.tree.mu.RUnlock()
+	if c.changes == c.tree.changes {
+		return c.forward(c.leaf, c.idx+1)
+	}
+
+	leaf, idx, err := c.tree.seek(c.key)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if leaf != nil && idx < int(leaf.Numkeys) && bytes.Equal(leaf.Keys[idx], c.key) {
+		idx++
+	}
+
+	return c.forward(leaf, idx)
+}
+
+// Moves to the previous entry. Returns false if the cursor was at the first entry or invalid.
+func (c *Cursor) Prev() bool {
+	if c.leaf == nil {
+		return false
+	}
+
+	c.tree.mu.RLock()
+	defer c.tree.mu.RUnlock()
+	if c.changes == c.tree.changes {
+		return c.backward(c.leaf, c.idx-1)
+	}
+
+	leaf, idx, err := c.tree.seek(c.key)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	return c.backward(leaf, idx-1)
+}
+
+// Reports whether the cursor is at an entry.
+func (c *Cursor) Valid() bool {
+	return c.leaf != nil
+}
+
+// Returns the key of the current entry, or nil if the cursor is invalid.
+func (c *Cursor) Key() []byte {
+	return c.key
+}
+
+// Returns the value of the current entry, or nil if the cursor is invalid.
+func (c *Cursor) Value() []byte {
+	return c.value
+}
+
+// Returns the error that made the cursor invalid, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Returns the first leaf of the tree, or the last one if `last` is true.
+// Returns nil if the tree is empty.
+func (t *DiskBTree) edgeLeaf(last bool) (*DiskBTreeNode, error) {
+	if t.masterPage == nil {
+		return nil, nil
+	}
+
+	node, err := t.readNode(t.masterPage.root)
+	if err != nil {
+		return nil, err
+	}
+
+	for !node.IsLeaf {
+		idx := uint16(0)
+		if last {
+			idx = node.Numkeys
+		}
+
+		ptr, ok := node.Pointers[idx].(uint64)
+		if !ok {
+			return nil, TYPE_CONVERSION_ERROR
+		}
+
+		node, err = t.readNode(ptr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// Returns the leaf `key` belongs in and the index of the first key in it that
+// is greater than or equal to `key`. The index is Numkeys if there is none.
+func (t *DiskBTree) seek(key []byte) (*DiskBTreeNode, int, error) {
+	if t.masterPage == nil {
+		return nil, 0, nil
+	}
+
+	leaf, err := t.findLeaf(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	idx := 0
+	for idx < int(leaf.Numkeys) && bytes.Compare(leaf.Keys[idx], key) < 0 {
+		idx++
+	}
+
+	return leaf, idx, nil
+}
+
+// Moves to the entry at `idx` in `leaf`, or to the first entry after it if there is none.
+func (c *Cursor) forward(leaf *DiskBTreeNode, idx int) bool {
+	for leaf != nil && idx >= int(leaf.Numkeys) {
+		if leaf.Next == 0 {
+			return c.set(nil, 0)
+		}
+
+		var err error
+		leaf, err = c.tree.readNode(leaf.Next)
+		if err != nil {
+			return c.fail(err)
+		}
+
+		idx = 0
+	}
+
+	return c.set(leaf, idx)
+}
+
+// Moves to the entry at `idx` in `leaf`, or to the last entry before it if there is none.
+func (c *Cursor) backward(leaf *DiskBTreeNode, idx int) bool {
+	for leaf != nil && idx < 0 {
+		if leaf.Prev == 0 {
+			return c.set(nil, 0)
+		}
+
+		var err error
+		leaf, err = c.tree.readNode(leaf.Prev)
+		if err != nil {
+			return c.fail(err)
+		}
+
+		idx = int(leaf.Numkeys) - 1
+	}
+
+	return c.set(leaf, idx)
+}
+
+func (c *Cursor) set(leaf *DiskBTreeNode, idx int) bool {
+	c.leaf, c.idx, c.changes = leaf, idx, c.tree.changes
+	if leaf == nil {
+		c.key, c.value = nil, nil
+		return false
+	}
+
+	val, err := c.tree.readLeafPointer(leaf.Pointers[idx])
+	if err != nil {
+		return c.fail(err)
+	}
+
+	// Keys and values may be shared with the buffer pool.
+	c.key, c.value = bytes.Clone(leaf.Keys[idx]), bytes.Clone(val)
+
+	return true
+}
+
+// Makes the cursor invalid because of `err`.
+func (c *Cursor) fail(err error) bool {
+	c.err = err
+	c.leaf, c.key, c.value = nil, nil, nil
+
+	return false
+}
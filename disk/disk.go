@@ -2,6 +2,7 @@ package disk
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -9,6 +10,9 @@ import (
 	"io/fs"
 	"math"
 	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
 // This DB consists of 3 parts, Head, one Master tree, and many subtrees.
@@ -23,150 +27,796 @@ import (
 // will be short above the subtrees and normal within the subtrees.
 
 // Order must not be less than 4.
-const m_ORDER = 4
-
-// Ceil the division. eg. 7/2 = 3, 7%2 = 1. 3+1 = 4.
-const m_ORDER_HALF = m_ORDER/2 + (m_ORDER % 2)
+const m_MIN_ORDER = 4
+const m_DEFAULT_ORDER = 4
 
 const m_MASTER_PAGE_SIZE = 4096
-const m_PAGE_SIZE = 8192
+
+// The master page is written to two slots in turns, so that one of them is always
+// intact if we crash while writing the other. Pages start after the slots.
+const m_MASTER_PAGE_SLOTS = 2
+const m_DATA_OFFSET = m_MASTER_PAGE_SLOTS * m_MASTER_PAGE_SIZE
+const m_DEFAULT_PAGE_SIZE = 8192
+
+// Offsets inside a page are stored as uint16, so pages can't be larger than 32KB.
+const m_MIN_PAGE_SIZE = 512
+const m_MAX_PAGE_SIZE = 32768
+
 const m_GCM_IV_SIZE = 12
 const m_GCM_AUTH_SIZE = 16
 const m_MASTER_PAGE_DATA_SIZE = m_MASTER_PAGE_SIZE - m_GCM_IV_SIZE - m_GCM_AUTH_SIZE
-const m_PAGE_DATA_SIZE = m_PAGE_SIZE - m_GCM_IV_SIZE - m_GCM_AUTH_SIZE
 
+// 1b isLeaf, 2b numkeys, 8b parent, 8b next, 8b prev, 2b cellsStart, 2b prefixLength
+const m_NODE_HEADER_SIZE = 31
+
+// Keys are stored in cells at the end of the page, and slots after the header
+// hold the offsets of the cells in key order.
+const m_SLOT_SIZE = 2
+const m_KEY_LENGTH_SIZE = 2
+
+// The first byte of every page tells what the page holds. For nodes, it doubles as isLeaf.
+const m_NODE_PAGE = 0
+const m_LEAF_PAGE = 1
+const m_OVERFLOW_PAGE = 2
+const m_FREE_PAGE = 3
+
+// 4 is m_TABLE_PAGE, the page table of copy-on-write trees.
+const m_COMPRESSED_LEAF_PAGE = 5
+
+// Identifies a file as a bptree disk file. It's the ascii encoding of "BPTD".
+const m_MAGIC_NUMBER = 0x42505444
+
+// Bump this whenever the on-disk layout changes in a way older code can't read.
+const m_FORMAT_VERSION = 9
+
+// Pages are read and written at their offset without moving a shared file offset,
+// so that concurrent reads don't interfere with each other.
 type DiskBTreeFile interface {
-	Read(b []byte) (int, error)
-	Write(b []byte) (int, error)
-	Seek(offset int64, whence int) (int64, error)
+	ReadAt(b []byte, offset int64) (int, error)
+	WriteAt(b []byte, offset int64) (int, error)
 	Truncate(size int64) error
 	Close() error
 	Stat() (fs.FileInfo, error)
+	Sync() error
 }
 
+type Options struct {
+	// The maximum number of children of a node. Setting it also caps leaves at
+	// Order-1 keys. Zero means nodes are filled by bytes for new trees, and the
+	// stored order is used for existing ones.
+	Order int
+	// The size of a node page in bytes. Zero means the default page size
+	// for new trees and the stored page size for existing ones.
+	PageSize int
+	// A 256-bit key to encrypt every page with AES-GCM. Nil means pages are
+	// stored unencrypted. An encrypted tree must always be opened with the
+	// key it was created with.
+	EncryptionKey []byte
+	// Write changed pages to new locations instead of overwriting them, which
+	// keeps the tree consistent after a crash without a write-ahead log.
+	// An existing tree must be opened with the mode it was created with.
+	CopyOnWrite bool
+	// The number of decoded pages kept in memory. Zero means the default size.
+	BufferPoolSize int
+	// Keep changed pages in memory until Flush, Sync or Close is called, or until
+	// there are FlushThreshold of them, instead of writing them after every
+	// operation. Changes that weren't flushed are lost on a crash.
+	WriteBack bool
+	// The number of changed pages that makes a write-back tree flush them.
+	// Zero means the default threshold.
+	FlushThreshold int
+	// When the files are synced to stable storage. Defaults to every write.
+	Durability Durability
+	// How often writes are synced with SYNC_PERIODIC. Zero means the default interval.
+	SyncInterval time.Duration
+	// Read pages from a memory mapping of the file instead of reading them from the
+	// file one by one. Only supported on Linux.
+	Mmap bool
+	// Store the prefix shared by the keys of a node once instead of in every key,
+	// which fits more keys in a node when they share long prefixes. It can only be
+	// set for new trees. Existing trees keep the setting they were created with.
+	PrefixCompression bool
+	// Compress leaves that don't fit in a page otherwise, so that they hold more
+	// entries when their values compress well. Trees compressed with
+	// DeflateCompressor are opened with it by default. Other compressors have to
+	// be passed every time the tree is opened.
+	Compressor Compressor
+}
+
+// Any number of goroutines can read from a tree at the same time. Writes are
+// exclusive, i.e. they wait for reads to finish and reads wait for them.
 type DiskBTree struct {
-	keySize    int
+	mu sync.RWMutex
+	// Zero means nodes are filled by bytes rather than capped by a number of keys.
+	order      uint16
+	orderHalf  uint16
+	pageSize   int
 	dbFile     DiskBTreeFile
 	masterPage *MasterPage
+	// Nil if the tree is not encrypted.
+	gcm cipher.AEAD
+	// Nil if the tree doesn't have a write-ahead log.
+	walFile DiskBTreeFile
+	// Whether the log holds the record of a failed commit that couldn't be replayed yet.
+	walNeedsReplay bool
+	// Pages waiting to be written to the file, keyed by their pointer.
+	pendingPages map[uint64][]byte
+	// What the current operation replaced, to undo it if it fails.
+	undoPages      map[uint64][]byte
+	undoMasterPage *MasterPage
+	writeBack      bool
+	flushThreshold int
+	durability     Durability
+	syncInterval   time.Duration
+	lastSync       time.Time
+	bufferPool     *bufferPool
+	// Closed by Close to stop flushing every sync interval. Nil if the tree doesn't.
+	stopPeriodicSync chan struct{}
+	periodicSyncDone chan struct{}
+	stopSyncingOnce  sync.Once
+	// Why the last flush in the background failed, until Flush, Sync or Close returns it.
+	periodicSyncErr error
+
+	copyOnWrite bool
+	// Maps logical page indexes to physical page ptrs in copy-on-write mode.
+	pageTable  []uint64
+	tablePages []uint64
+	// Physical pages that aren't used by the current version of the tree.
+	freePhysicalPages []uint64
+	// Physical pages used by the current version that can be reused once
+	// the next version is published.
+	releasedPhysicalPages []uint64
+
+	prefixCompression bool
+	// Nil if leaves aren't compressed.
+	compressor       Compressor
+	compressionCache []compressedLeaf
+	// Counts the write operations, so that cursors know when the leaves they're at
+	// might have changed.
+	changes uint64
 }
 
 func NewTree(filePath string) (*DiskBTree, error) {
-	f, err := os.OpenFile(filePath, os.O_RDWR, 0700)
+	return NewTreeWithOptions(filePath, Options{})
+}
+
+func NewTreeWithOptions(filePath string, opts Options) (*DiskBTree, error) {
+	osFile, err := os.OpenFile(filePath, os.O_RDWR, 0700)
 	if err != nil {
 		return nil, err
 	}
 
-	return newTreeFromFile(f)
+	var f DiskBTreeFile = osFile
+	if opts.Mmap {
+		f, err = newMmapFile(osFile)
+		if err != nil {
+			osFile.Close()
+			return nil, err
+		}
+	}
+
+	// Copy-on-write trees don't need a log.
+	var walFile DiskBTreeFile
+	if !opts.CopyOnWrite {
+		walFile, err = os.OpenFile(filePath+"-wal", os.O_RDWR|os.O_CREATE, 0700)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	tree, err := newTreeFromFiles(f, walFile, opts)
+	if err != nil {
+		f.Close()
+		if walFile != nil {
+			walFile.Close()
+		}
+
+		return nil, err
+	}
+
+	return tree, nil
 }
 
 func newTreeFromFile(f DiskBTreeFile) (*DiskBTree, error) {
+	return newTreeFromFileWithOptions(f, Options{})
+}
+
+func newTreeFromFileWithOptions(f DiskBTreeFile, opts Options) (*DiskBTree, error) {
+	return newTreeFromFiles(f, nil, opts)
+}
+
+// Opens the tree stored in `f`. `walFile` is used as the write-ahead log of the tree
+// and any record left in it is replayed first. It can be nil to not use a log, and
+// it's not used in copy-on-write mode.
+func newTreeFromFiles(f, walFile DiskBTreeFile, opts Options) (*DiskBTree, error) {
+	if opts.Order != 0 && (opts.Order < m_MIN_ORDER || opts.Order > math.MaxUint16) {
+		return nil, INVALID_ORDER_ERROR
+	}
+
+	if opts.PageSize != 0 && (opts.PageSize < m_MIN_PAGE_SIZE || opts.PageSize > m_MAX_PAGE_SIZE) {
+		return nil, INVALID_PAGE_SIZE_ERROR
+	}
+
+	if opts.BufferPoolSize < 0 {
+		return nil, INVALID_BUFFER_POOL_SIZE_ERROR
+	}
+
+	if opts.FlushThreshold < 0 {
+		return nil, INVALID_FLUSH_THRESHOLD_ERROR
+	}
+
+	if opts.Durability < SYNC_ON_WRITE || opts.Durability > SYNC_PERIODIC {
+		return nil, INVALID_DURABILITY_ERROR
+	}
+
+	if opts.SyncInterval < 0 {
+		return nil, INVALID_SYNC_INTERVAL_ERROR
+	}
+
+	if opts.Compressor != nil && opts.Compressor.ID() == m_NO_CODEC {
+		return nil, INVALID_COMPRESSOR_ERROR
+	}
+
+	syncInterval := m_DEFAULT_SYNC_INTERVAL
+	if opts.SyncInterval != 0 {
+		syncInterval = opts.SyncInterval
+	}
+
+	flushThreshold := m_DEFAULT_FLUSH_THRESHOLD
+	if opts.FlushThreshold != 0 {
+		flushThreshold = opts.FlushThreshold
+	}
+
+	bufferPoolSize := m_DEFAULT_BUFFER_POOL_SIZE
+	if opts.BufferPoolSize != 0 {
+		bufferPoolSize = opts.BufferPoolSize
+	}
+
+	diskBTree := DiskBTree{
+		dbFile:         f,
+		pageSize:       m_DEFAULT_PAGE_SIZE,
+		walFile:        walFile,
+		pendingPages:   make(map[uint64][]byte),
+		undoPages:      make(map[uint64][]byte),
+		writeBack:      opts.WriteBack,
+		flushThreshold: flushThreshold,
+		durability:     opts.Durability,
+		syncInterval:   syncInterval,
+		lastSync:       time.Now(),
+		bufferPool:     newBufferPool(bufferPoolSize),
+		copyOnWrite:    opts.CopyOnWrite,
+
+		prefixCompression: opts.PrefixCompression,
+		compressor:        opts.Compressor,
+	}
+
+	if walFile != nil && !opts.CopyOnWrite {
+		err := diskBTree.replayWAL()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	stats, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	diskBTree := DiskBTree{
-		dbFile: f,
+	if opts.EncryptionKey != nil {
+		diskBTree.gcm, err = newPageCipher(opts.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Order != 0 {
+		diskBTree.order = uint16(opts.Order)
+	}
+
+	if opts.PageSize != 0 {
+		diskBTree.pageSize = opts.PageSize
 	}
 
-	if stats.Size() > m_MASTER_PAGE_SIZE {
+	if stats.Size() > 0 {
 		err = diskBTree.readMasterPage()
 		if err != nil {
 			return nil, err
 		}
+
+		err = diskBTree.validateMasterPage(stats.Size())
+		if err != nil {
+			return nil, err
+		}
+
+		// Options can't change the layout of an existing tree.
+		mp := diskBTree.masterPage
+		if opts.Order != 0 && opts.Order != int(mp.order) {
+			return nil, INVALID_ORDER_ERROR
+		}
+
+		if opts.PageSize != 0 && opts.PageSize != int(mp.pageSize) {
+			return nil, INVALID_PAGE_SIZE_ERROR
+		}
+
+		if opts.CopyOnWrite != mp.copyOnWrite {
+			return nil, COPY_ON_WRITE_MISMATCH_ERROR
+		}
+
+		if opts.PrefixCompression && !mp.prefixCompression {
+			return nil, PREFIX_COMPRESSION_MISMATCH_ERROR
+		}
+
+		// Compression can be turned on for an existing tree since every page records
+		// its codec, but its codec can't change afterwards.
+		if mp.codec == m_NO_CODEC {
+			mp.codec = diskBTree.codecID()
+		} else if opts.Compressor == nil && mp.codec == m_DEFLATE_CODEC {
+			diskBTree.compressor = DeflateCompressor{}
+		} else if opts.Compressor == nil || opts.Compressor.ID() != mp.codec {
+			return nil, COMPRESSOR_MISMATCH_ERROR
+		}
+
+		diskBTree.order = mp.order
+		diskBTree.prefixCompression = mp.prefixCompression
+		diskBTree.pageSize = int(mp.pageSize)
+		if diskBTree.copyOnWrite {
+			err = diskBTree.loadPageTable()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	diskBTree.setOrder(diskBTree.order)
+	if diskBTree.durability == SYNC_PERIODIC && !diskBTree.writeBack {
+		diskBTree.startPeriodicSync()
 	}
 
 	return &diskBTree, nil
 }
 
+func (t *DiskBTree) setOrder(order uint16) {
+	t.order = order
+	// Ceil the division. eg. 7/2 = 3, 7%2 = 1. 3+1 = 4.
+	t.orderHalf = order/2 + (order % 2)
+}
+
+// Keys are limited so that a leaf entry with its value in overflow pages is still small
+// enough to be inlined. Every entry then takes up at most a quarter of a page, so full
+// nodes can always be split in two and non leaf nodes always fit at least 3 keys.
+func (t *DiskBTree) maxKeySize() int {
+	return t.maxInlineEntrySize() - m_SLOT_SIZE - m_KEY_LENGTH_SIZE - leafValueSize(overflowValue{})
+}
+
+// Reads the newest intact master page. If neither slot is intact, the error of the first slot is returned.
 func (t *DiskBTree) readMasterPage() error {
-	_, err := t.dbFile.Seek(0, io.SeekStart)
-	if err != nil {
-		return err
+	var newest *MasterPage
+	var firstErr error
+	for slot := uint64(0); slot < m_MASTER_PAGE_SLOTS; slot++ {
+		mp, err := t.readMasterPageSlot(slot * m_MASTER_PAGE_SIZE)
+		if err == UNSUPPORTED_VERSION_ERROR {
+			return err
+		}
+
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			continue
+		}
+
+		if newest == nil || mp.sequence > newest.sequence {
+			newest = mp
+		}
+	}
+
+	if newest == nil {
+		return firstErr
 	}
 
+	t.masterPage = newest
+
+	return nil
+}
+
+func (t *DiskBTree) readMasterPageSlot(ptr uint64) (*MasterPage, error) {
 	masterpageBytes := make([]byte, m_MASTER_PAGE_SIZE)
-	_, err = t.dbFile.Read(masterpageBytes)
+	n, err := t.dbFile.ReadAt(masterpageBytes, int64(ptr))
+	if err == io.EOF || err == io.ErrUnexpectedEOF || n != m_MASTER_PAGE_SIZE {
+		return nil, INVALID_FILE_ERROR
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t.gcm == nil {
+		// Files that aren't trees or were written by another version don't have a
+		// valid checksum either, so we report that first.
+		err = BytesToMasterPage(masterpageBytes).validateHeader()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	masterpageBytes, err = t.openPage(masterpageBytes, m_MASTER_PAGE_DATA_SIZE, ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	return BytesToMasterPage(masterpageBytes), nil
+}
+
+// Makes sure the master page describes a tree this code can read and that
+// its pointers don't go past the end of a file of `fileSize` bytes.
+func (t *DiskBTree) validateMasterPage(fileSize int64) error {
+	mp := t.masterPage
+	err := mp.validateHeader()
 	if err != nil {
 		return err
 	}
 
-	rootPtr := binary.BigEndian.Uint64(masterpageBytes[0:8])
-	pageCount := binary.BigEndian.Uint64(masterpageBytes[8:16])
+	if mp.pageSize < m_MIN_PAGE_SIZE || mp.pageSize > m_MAX_PAGE_SIZE {
+		return INVALID_PAGE_SIZE_ERROR
+	}
 
-	t.masterPage = &MasterPage{root: rootPtr, pageCount: pageCount}
+	if mp.order != 0 && mp.order < m_MIN_ORDER {
+		return INVALID_ORDER_ERROR
+	}
+
+	pageSize := uint64(mp.pageSize)
+	filePageCount := mp.pageCount
+	if mp.copyOnWrite {
+		// Logical pages are spread over the physical pages of the file.
+		filePageCount = mp.physicalPageCount
+		if mp.physicalPageCount < mp.pageCount {
+			return INVALID_FILE_ERROR
+		}
+	}
+
+	if mp.pageCount == 0 || int64(m_DATA_OFFSET+filePageCount*pageSize) > fileSize {
+		return INVALID_FILE_ERROR
+	}
+
+	if !mp.isValidPagePtr(mp.root) {
+		return INVALID_FILE_ERROR
+	}
+
+	if mp.freeListHead != 0 && !mp.isValidPagePtr(mp.freeListHead) {
+		return INVALID_FILE_ERROR
+	}
+
+	if mp.freePageCount >= mp.pageCount {
+		return INVALID_FILE_ERROR
+	}
 
 	return nil
 }
 
+// Stages the master page to be written to the slot after the one of the current master page.
 func (t *DiskBTree) writeMasterPage() error {
-	_, err := t.dbFile.Seek(0, io.SeekStart)
+	masterpageBytes, slot, err := t.sealMasterPage()
 	if err != nil {
 		return err
 	}
 
-	masterpageBytes := make([]byte, 4096)
-	binary.BigEndian.PutUint64(masterpageBytes[0:8], t.masterPage.root)
-	binary.BigEndian.PutUint64(masterpageBytes[8:16], t.masterPage.pageCount)
+	t.stagePage(masterpageBytes, slot)
 
-	_, err = t.dbFile.Write(masterpageBytes)
+	return nil
+}
 
-	return err
+// Returns the ptr of the slot the next master page is written to.
+func (t *DiskBTree) nextMasterPageSlot() uint64 {
+	return ((t.masterPage.sequence + 1) % m_MASTER_PAGE_SLOTS) * m_MASTER_PAGE_SIZE
 }
 
+// Returns the master page with the next sequence number, ready to be written to the returned slot.
+// The sequence number of the master page is only increased once it's on disk.
+func (t *DiskBTree) sealMasterPage() ([]byte, uint64, error) {
+	mp := *t.masterPage
+	mp.sequence++
+	slot := t.nextMasterPageSlot()
+	masterpageBytes, err := t.sealPage(mp.ToBytes(), m_MASTER_PAGE_DATA_SIZE, slot)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return masterpageBytes, slot, nil
+}
+
+// Returns a copy of the node at `ptr` that can be changed freely.
 func (t *DiskBTree) readNode(ptr uint64) (*DiskBTreeNode, error) {
+	if node, ok := t.bufferPool.get(ptr); ok {
+		return node.clone(), nil
+	}
+
+	nodeBytes, err := t.readPage(ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	if nodeBytes[0] == m_COMPRESSED_LEAF_PAGE {
+		nodeBytes, err = t.decompressLeaf(nodeBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if nodeBytes[0] != m_NODE_PAGE && nodeBytes[0] != m_LEAF_PAGE {
+		return nil, INVALID_PAGE_TYPE_ERROR
+	}
+
+	node := BytesToNode(nodeBytes, ptr)
+	t.bufferPool.put(ptr, node)
+
+	return node.clone(), nil
+}
+
+func (t *DiskBTree) writeNode(node *DiskBTreeNode) error {
+	nodeBytes, err := t.encodeNode(node)
+	if err != nil {
+		return err
+	}
+
+	err = t.writePage(nodeBytes, node.Ptr)
+	if err != nil {
+		return err
+	}
+
+	t.bufferPool.put(node.Ptr, node.clone())
+
+	return nil
+}
+
+func (t *DiskBTree) readPage(ptr uint64) ([]byte, error) {
 	if t.masterPage == nil {
 		return nil, errors.New("Tree is empty")
 	}
 
 	// Check if ptr is trying to read data more than dbFile size
-	if ptr > (t.masterPage.pageCount-1)*m_PAGE_SIZE+m_MASTER_PAGE_SIZE {
+	if ptr > (t.masterPage.pageCount-1)*uint64(t.pageSize)+m_DATA_OFFSET {
 		return nil, errors.New("Invalid read index")
 	}
 
-	nodeBytes := make([]byte, m_PAGE_SIZE)
-	_, err := t.dbFile.Seek(int64(ptr), io.SeekStart)
-	if err != nil {
-		return nil, err
+	if pendingBytes, ok := t.pendingPages[ptr]; ok {
+		// Copy the page since values are returned as slices of it.
+		pageBytes := append([]byte(nil), pendingBytes...)
+		return t.openPage(pageBytes, t.pageDataSize(), ptr)
 	}
 
-	n, err := t.dbFile.Read(nodeBytes)
+	filePtr := ptr
+	if t.copyOnWrite {
+		var err error
+		filePtr, err = t.physicalPtr(ptr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pageBytes, err := t.readFilePage(filePtr)
 	if err != nil {
 		return nil, err
 	}
 
-	if n != m_PAGE_SIZE {
-		return nil, errors.New("Unexpected size was read")
+	return t.openPage(pageBytes, t.pageDataSize(), ptr)
+}
+
+// Reads the page at `ptr` in the file as is.
+func (t *DiskBTree) readFilePage(ptr uint64) ([]byte, error) {
+	pageBytes := make([]byte, t.pageSize)
+	n, err := t.dbFile.ReadAt(pageBytes, int64(ptr))
+	if n != t.pageSize {
+		if err == nil || err == io.EOF {
+			return nil, errors.New("Unexpected size was read")
+		}
+
+		return nil, err
 	}
 
-	return BytesToNode(nodeBytes, ptr), nil
+	return pageBytes, nil
 }
 
-func (t *DiskBTree) writeNode(nodeBytes []byte, ptr uint64) error {
-	_, err := t.dbFile.Seek(int64(ptr), io.SeekStart)
+// Stages the page to be written with the other pages of the current operation.
+func (t *DiskBTree) writePage(pageBytes []byte, ptr uint64) error {
+	pageBytes, err := t.sealPage(pageBytes, t.pageDataSize(), ptr)
 	if err != nil {
 		return err
 	}
 
-	n, err := t.dbFile.Write(nodeBytes)
+	t.stagePage(pageBytes, ptr)
+
+	return nil
+}
+
+func writeAt(f DiskBTreeFile, b []byte, offset int64) error {
+	n, err := f.WriteAt(b, offset)
 	if err != nil {
 		return err
 	}
 
-	if n != len(nodeBytes) {
+	if n != len(b) {
 		return errors.New("Unexpected size was written")
 	}
 
 	return nil
 }
 
+// The part of a page that can hold node data. The rest is reserved for encryption.
+func (t *DiskBTree) pageDataSize() int {
+	return t.pageSize - m_GCM_IV_SIZE - m_GCM_AUTH_SIZE
+}
+
+// Flushes the staged pages and closes the files of the tree.
 func (t *DiskBTree) Close() error {
-	return t.dbFile.Close()
+	t.stopSyncing()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	flushErr := t.flush()
+	if err := t.takePeriodicSyncErr(); err != nil {
+		flushErr = err
+	}
+
+	if t.walFile != nil {
+		err := t.walFile.Close()
+		if err != nil {
+			t.dbFile.Close()
+			return err
+		}
+	}
+
+	err := t.dbFile.Close()
+	if flushErr != nil {
+		return flushErr
+	}
+
+	return err
+}
+
+// Returns the number of entries stored in the tree.
+func (t *DiskBTree) Count() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.masterPage == nil {
+		return 0
+	}
+
+	return t.masterPage.entryCount
 }
 
 type MasterPage struct {
-	root      uint64
-	pageCount uint64
+	magic      uint32
+	version    uint16
+	pageSize   uint32
+	order      uint16
+	root       uint64
+	pageCount  uint64
+	entryCount uint64
+	// The first page of the free pages list, 0 if there are no free pages.
+	freeListHead  uint64
+	freePageCount uint64
+	// Increased every time the master page is written. The slot with the
+	// larger sequence number holds the current master page.
+	sequence uint64
+
+	copyOnWrite bool
+	// The number of pages in the file in copy-on-write mode. It's larger than
+	// pageCount since older versions of pages and the page table take up space as well.
+	physicalPageCount uint64
+	// The physical ptrs of the page table directory pages.
+	tableDir []uint64
+
+	prefixCompression bool
+	// The codec of compressed leaves, m_NO_CODEC if leaves aren't compressed.
+	codec uint8
+}
+
+func (t *DiskBTree) newMasterPage(root uint64) *MasterPage {
+	return &MasterPage{
+		magic:     m_MAGIC_NUMBER,
+		version:   m_FORMAT_VERSION,
+		pageSize:  uint32(t.pageSize),
+		order:     t.order,
+		root:      root,
+		pageCount: 1,
+
+		copyOnWrite:       t.copyOnWrite,
+		prefixCompression: t.prefixCompression,
+		codec:             t.codecID(),
+	}
+}
+
+// 4b magic, 2b version, 4b pageSize, 2b order, 1b codec, 1b unused, 8b root, 8b pageCount, 8b entryCount,
+// 2b unused, 8b freeListHead, 8b freePageCount, 8b sequence, 1b flags, 8b physicalPageCount,
+// 2b tableDirSize, tableDirSize * 8b tableDir
+// The flags are m_COPY_ON_WRITE_FLAG and m_PREFIX_COMPRESSION_FLAG.
+func (mp *MasterPage) ToBytes() []byte {
+	masterpageBytes := make([]byte, m_MASTER_PAGE_SIZE)
+	binary.BigEndian.PutUint32(masterpageBytes[0:4], mp.magic)
+	binary.BigEndian.PutUint16(masterpageBytes[4:6], mp.version)
+	binary.BigEndian.PutUint32(masterpageBytes[6:10], mp.pageSize)
+	binary.BigEndian.PutUint16(masterpageBytes[10:12], mp.order)
+	masterpageBytes[12] = mp.codec
+	binary.BigEndian.PutUint64(masterpageBytes[14:22], mp.root)
+	binary.BigEndian.PutUint64(masterpageBytes[22:30], mp.pageCount)
+	binary.BigEndian.PutUint64(masterpageBytes[30:38], mp.entryCount)
+	binary.BigEndian.PutUint64(masterpageBytes[40:48], mp.freeListHead)
+	binary.BigEndian.PutUint64(masterpageBytes[48:56], mp.freePageCount)
+	binary.BigEndian.PutUint64(masterpageBytes[56:64], mp.sequence)
+	if mp.copyOnWrite {
+		masterpageBytes[64] |= m_COPY_ON_WRITE_FLAG
+	}
+
+	if mp.prefixCompression {
+		masterpageBytes[64] |= m_PREFIX_COMPRESSION_FLAG
+	}
+
+	binary.BigEndian.PutUint64(masterpageBytes[65:73], mp.physicalPageCount)
+	binary.BigEndian.PutUint16(masterpageBytes[73:75], uint16(len(mp.tableDir)))
+	for i, ptr := range mp.tableDir {
+		start := m_MASTER_PAGE_COW_OFFSET + m_MASTER_PAGE_COW_HEADER_SIZE + i*8
+		binary.BigEndian.PutUint64(masterpageBytes[start:start+8], ptr)
+	}
+
+	return masterpageBytes
+}
+
+// Makes sure the master page belongs to a tree file of the current version.
+func (mp *MasterPage) validateHeader() error {
+	if mp.magic != m_MAGIC_NUMBER {
+		return INVALID_FILE_ERROR
+	}
+
+	if mp.version != m_FORMAT_VERSION {
+		return UNSUPPORTED_VERSION_ERROR
+	}
+
+	return nil
+}
+
+// Reports whether `ptr` points to the start of one of the pages in the file.
+func (mp *MasterPage) isValidPagePtr(ptr uint64) bool {
+	pageSize := uint64(mp.pageSize)
+	return ptr >= m_DATA_OFFSET && ptr <= (mp.pageCount-1)*pageSize+m_DATA_OFFSET &&
+		(ptr-m_DATA_OFFSET)%pageSize == 0
+}
+
+// Reports whether `ptr` points to the start of one of the physical pages in copy-on-write mode.
+func (mp *MasterPage) isValidPhysicalPtr(ptr uint64) bool {
+	pageSize := uint64(mp.pageSize)
+	return ptr >= m_DATA_OFFSET && ptr <= (mp.physicalPageCount-1)*pageSize+m_DATA_OFFSET &&
+		(ptr-m_DATA_OFFSET)%pageSize == 0
+}
+
+func BytesToMasterPage(b []byte) *MasterPage {
+	mp := &MasterPage{
+		magic:      binary.BigEndian.Uint32(b[0:4]),
+		version:    binary.BigEndian.Uint16(b[4:6]),
+		pageSize:   binary.BigEndian.Uint32(b[6:10]),
+		order:      binary.BigEndian.Uint16(b[10:12]),
+		codec:      b[12],
+		root:       binary.BigEndian.Uint64(b[14:22]),
+		pageCount:  binary.BigEndian.Uint64(b[22:30]),
+		entryCount: binary.BigEndian.Uint64(b[30:38]),
+
+		freeListHead:  binary.BigEndian.Uint64(b[40:48]),
+		freePageCount: binary.BigEndian.Uint64(b[48:56]),
+		sequence:      binary.BigEndian.Uint64(b[56:64]),
+
+		copyOnWrite:       b[64]&m_COPY_ON_WRITE_FLAG != 0,
+		prefixCompression: b[64]&m_PREFIX_COMPRESSION_FLAG != 0,
+		physicalPageCount: binary.BigEndian.Uint64(b[65:73]),
+	}
+
+	tableDirSize := min(int(binary.BigEndian.Uint16(b[73:75])), m_MAX_TABLE_DIR_SIZE)
+	mp.tableDir = make([]uint64, tableDirSize)
+	for i := range mp.tableDir {
+		start := m_MASTER_PAGE_COW_OFFSET + m_MASTER_PAGE_COW_HEADER_SIZE + i*8
+		mp.tableDir[i] = binary.BigEndian.Uint64(b[start : start+8])
+	}
+
+	return mp
 }
 
 type DiskBTreeNode struct {
@@ -176,15 +826,27 @@ type DiskBTreeNode struct {
 	Parent   uint64
 	Next     uint64
 	Prev     uint64
-	Keysize  uint16
 	Keys     [][]byte
 	Pointers []interface{}
 }
 
-// 1b isLeaf, 2b numkeys, 8b parent, 8b next, 8b prev, 2b keysize,
-// (keysize * numkeys) keys, isLeaf ? ((2b dataLength + data) * numkeys) else ((numkeys + 1) * 8)
-func (n *DiskBTreeNode) ToBytes() []byte {
-	nodeBytes := make([]byte, m_PAGE_SIZE)
+// 1b isLeaf, 2b numkeys, 8b parent, 8b next, 8b prev, 2b cellsStart, 2b prefixLength,
+// isLeaf ? nothing : ((numkeys + 1) * 8b pointers), numkeys * 2b slots, free space, prefix, cells.
+// The prefix and the cells are written backwards from the end of the page data, so the free
+// space is between the slots and cellsStart, where the prefix starts. Each slot holds the offset
+// of the cell of its key.
+// Leaf cells are 2b keyLength, key, 2b dataLength, data. Non leaf cells are 2b keyLength, key.
+// Keys in cells don't include the prefix.
+// Values stored in overflow pages have m_OVERFLOW_MARKER as dataLength, followed by
+// 8b length and 8b ptr to the first overflow page as data.
+func (n *DiskBTreeNode) ToBytes(pageSize int) []byte {
+	return n.toBytes(pageSize, 0)
+}
+
+// Encodes the node like ToBytes, but stores the first `prefixLength` bytes of the keys
+// once. All keys must share them.
+func (n *DiskBTreeNode) toBytes(pageSize, prefixLength int) []byte {
+	nodeBytes := make([]byte, pageSize)
 	if n.IsLeaf {
 		nodeBytes[0] = 1
 	}
@@ -193,47 +855,116 @@ func (n *DiskBTreeNode) ToBytes() []byte {
 	binary.BigEndian.PutUint64(nodeBytes[3:11], n.Parent)
 	binary.BigEndian.PutUint64(nodeBytes[11:19], n.Next)
 	binary.BigEndian.PutUint64(nodeBytes[19:27], n.Prev)
-	binary.BigEndian.PutUint16(nodeBytes[27:29], n.Keysize)
 
-	// Keys encoding
-	start := uint16(29)
-	end := start + n.Keysize
+	slot := m_NODE_HEADER_SIZE
+	if !n.IsLeaf {
+		// We do <= because in non leaf nodes, pointers are more than keys by 1
+		for i := uint16(0); i <= n.Numkeys; i++ {
+			binary.BigEndian.PutUint64(nodeBytes[slot:slot+8], n.Pointers[i].(uint64))
+			slot += 8
+		}
+	}
+
+	// The cells are laid out in key order after the prefix, so the prefix starts
+	// where the cells of all the keys end.
+	cellsStart := pageSize - m_GCM_IV_SIZE - m_GCM_AUTH_SIZE - prefixLength
 	for i := uint16(0); i < n.Numkeys; i++ {
-		copy(nodeBytes[start:end], n.Keys[i])
+		cellsStart -= n.cellSize(i) - prefixLength
+	}
 
-		start = end
-		end += n.Keysize
+	binary.BigEndian.PutUint16(nodeBytes[27:29], uint16(cellsStart))
+	binary.BigEndian.PutUint16(nodeBytes[29:31], uint16(prefixLength))
+	start := cellsStart
+	if n.Numkeys > 0 {
+		start += copy(nodeBytes[start:], n.Keys[0][:prefixLength])
 	}
 
-	// Pointers encoding
-	if n.IsLeaf {
-		for i := uint16(0); i < n.Numkeys; i++ {
-			val := n.Pointers[i].([]byte)
-			dataLength := uint16(len(val))
-			end = start + 2
-			binary.BigEndian.PutUint16(nodeBytes[start:end], dataLength)
+	for i := uint16(0); i < n.Numkeys; i++ {
+		binary.BigEndian.PutUint16(nodeBytes[slot:slot+m_SLOT_SIZE], uint16(start))
+		slot += m_SLOT_SIZE
+
+		key := n.Keys[i][prefixLength:]
+		binary.BigEndian.PutUint16(nodeBytes[start:start+m_KEY_LENGTH_SIZE], uint16(len(key)))
+		start += m_KEY_LENGTH_SIZE
+		start += copy(nodeBytes[start:], key)
+		if !n.IsLeaf {
+			continue
+		}
 
-			start = end // Resetting start to write the value
-			end += dataLength
-			copy(nodeBytes[start:end], val)
-			start = end // Resettings start to write the length
+		if ref, ok := n.Pointers[i].(overflowValue); ok {
+			binary.BigEndian.PutUint16(nodeBytes[start:start+2], m_OVERFLOW_MARKER)
+			binary.BigEndian.PutUint64(nodeBytes[start+2:start+10], ref.length)
+			binary.BigEndian.PutUint64(nodeBytes[start+10:start+18], ref.ptr)
+			start += 2 + m_OVERFLOW_REF_SIZE
+			continue
 		}
 
-	} else {
-		// In non-leaf nodes, we're storing pointers which are 8 bytes long
-		// so, we need to set the end accordingly
-		end = start + 8
+		val := n.Pointers[i].([]byte)
+		binary.BigEndian.PutUint16(nodeBytes[start:start+2], uint16(len(val)))
+		start += 2
+		start += copy(nodeBytes[start:], val)
+	}
 
-		// We do <= because in non leaf nodes, pointers are more than keys by 1
-		for i := uint16(0); i <= n.Numkeys; i++ {
-			binary.BigEndian.PutUint64(nodeBytes[start:end], n.Pointers[i].(uint64))
+	return nodeBytes
+}
 
-			start = end
-			end += 8
-		}
+// Returns the number of bytes the cell of the key at `idx` takes up without a prefix.
+func (n *DiskBTreeNode) cellSize(idx uint16) int {
+	size := m_KEY_LENGTH_SIZE + len(n.Keys[idx])
+	if n.IsLeaf {
+		size += leafValueSize(n.Pointers[idx])
 	}
 
-	return nodeBytes
+	return size
+}
+
+// Returns the number of bytes `n` takes up when encoded with ToBytes.
+func (n *DiskBTreeNode) encodedSize() int {
+	return m_NODE_HEADER_SIZE + n.payloadSize()
+}
+
+// Returns the number of bytes `n` takes up after the header.
+func (n *DiskBTreeNode) payloadSize() int {
+	size := 0
+	if !n.IsLeaf {
+		// The first pointer. The others are counted with the keys before them.
+		size += 8
+	}
+
+	for i := uint16(0); i < n.Numkeys; i++ {
+		size += entrySize(n.IsLeaf, n.Keys[i], n.Pointers[i])
+	}
+
+	return size
+}
+
+// Returns the number of bytes `key` and its pointer take up in a node, including its
+// slot. The pointer of a key in a non leaf node is the one after it.
+func entrySize(isLeaf bool, key []byte, pointer interface{}) int {
+	size := m_SLOT_SIZE + m_KEY_LENGTH_SIZE + len(key)
+	if !isLeaf {
+		return size + 8
+	}
+
+	return size + leafValueSize(pointer)
+}
+
+// Returns the number of bytes a leaf pointer takes up in a leaf, including its length.
+func leafValueSize(pointer interface{}) int {
+	if _, ok := pointer.(overflowValue); ok {
+		return 2 + m_OVERFLOW_REF_SIZE
+	}
+
+	return 2 + len(pointer.([]byte))
+}
+
+// Returns a copy of the node whose keys and pointers can be changed without changing n.
+func (n *DiskBTreeNode) clone() *DiskBTreeNode {
+	node := *n
+	node.Keys = append([][]byte(nil), n.Keys...)
+	node.Pointers = append([]interface{}(nil), n.Pointers...)
+
+	return &node
 }
 
 func BytesToNode(b []byte, ptr uint64) *DiskBTreeNode {
@@ -245,52 +976,58 @@ func BytesToNode(b []byte, ptr uint64) *DiskBTreeNode {
 	node.Parent = binary.BigEndian.Uint64(b[3:11])
 	node.Next = binary.BigEndian.Uint64(b[11:19])
 	node.Prev = binary.BigEndian.Uint64(b[19:27])
-	node.Keysize = binary.BigEndian.Uint16(b[27:29])
-	node.Keys = make([][]byte, m_ORDER-1)
-	node.Pointers = make([]interface{}, m_ORDER)
-
-	start := uint16(29)
-	end := start + node.Keysize
-	for i := uint16(0); i < node.Numkeys; i++ {
-		node.Keys[i] = make([]byte, node.Keysize)
-		copy(node.Keys[i], b[start:end])
+	// Leave room for one more key since most nodes are read to be modified.
+	node.Keys = make([][]byte, node.Numkeys+1)
+	node.Pointers = make([]interface{}, node.Numkeys+2)
 
-		start = end
-		end += node.Keysize
+	slot := m_NODE_HEADER_SIZE
+	if !node.IsLeaf {
+		// We do <= because in non leaf nodes, pointers are more than keys by 1
+		for i := uint16(0); i <= node.Numkeys; i++ {
+			node.Pointers[i] = binary.BigEndian.Uint64(b[slot : slot+8])
+			slot += 8
+		}
 	}
 
-	if node.IsLeaf {
-		for i := uint16(0); i < node.Numkeys; i++ {
-			end = start + 2
-			valueLength := binary.BigEndian.Uint16(b[start:end])
-			start = end
-			end += valueLength
-			node.Pointers[i] = b[start:end]
-			start = end
+	cellsStart := int(binary.BigEndian.Uint16(b[27:29]))
+	prefix := b[cellsStart : cellsStart+int(binary.BigEndian.Uint16(b[29:31]))]
+	for i := uint16(0); i < node.Numkeys; i++ {
+		start := int(binary.BigEndian.Uint16(b[slot : slot+m_SLOT_SIZE]))
+		slot += m_SLOT_SIZE
+
+		keyLength := int(binary.BigEndian.Uint16(b[start : start+m_KEY_LENGTH_SIZE]))
+		start += m_KEY_LENGTH_SIZE
+		node.Keys[i] = make([]byte, 0, len(prefix)+keyLength)
+		node.Keys[i] = append(node.Keys[i], prefix...)
+		node.Keys[i] = append(node.Keys[i], b[start:start+keyLength]...)
+		start += keyLength
+		if !node.IsLeaf {
+			continue
 		}
-	} else {
-		end = start + 8
 
-		// We do <= because in non leaf nodes, pointers are more than keys by 1
-		for i := uint16(0); i <= node.Numkeys; i++ {
-			node.Pointers[i] = binary.BigEndian.Uint64(b[start:end])
-			start = end
-			end += 8
+		valueLength := binary.BigEndian.Uint16(b[start : start+2])
+		start += 2
+		if valueLength == m_OVERFLOW_MARKER {
+			node.Pointers[i] = overflowValue{
+				length: binary.BigEndian.Uint64(b[start : start+8]),
+				ptr:    binary.BigEndian.Uint64(b[start+8 : start+16]),
+			}
+			continue
 		}
+
+		node.Pointers[i] = b[start : start+int(valueLength)]
 	}
 
 	return &node
 }
 
 func (t *DiskBTree) Find(key []byte) ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	if t.masterPage == nil || key == nil {
 		return nil, KEY_NOT_FOUND_ERROR
 	}
 
-	if len(key) != t.keySize {
-		return nil, INVALID_KEY_SIZE_ERROR
-	}
-
 	leaf, err := t.findLeaf(key)
 	if err != nil {
 		return nil, err
@@ -301,21 +1038,28 @@ func (t *DiskBTree) Find(key []byte) ([]byte, error) {
 		return nil, KEY_NOT_FOUND_ERROR
 	}
 
-	val, ok := leaf.Pointers[idx].([]byte)
-	if !ok {
-		return nil, TYPE_CONVERSION_ERROR
+	val, err := t.readLeafPointer(leaf.Pointers[idx])
+	if err != nil {
+		return nil, err
 	}
 
-	return val, nil
+	// The value may be shared with the buffer pool.
+	return bytes.Clone(val), nil
 }
 
-func (t *DiskBTree) Update(key, newValue []byte) error {
-	if t.masterPage == nil || key == nil {
-		return KEY_NOT_FOUND_ERROR
+func (t *DiskBTree) Update(key, newValue []byte) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err = t.replayFailedCommit()
+	if err != nil {
+		return err
 	}
 
-	if len(key) != t.keySize {
-		return INVALID_KEY_SIZE_ERROR
+	t.beginWrite()
+	defer func() { err = t.finishWrite(err) }()
+
+	if t.masterPage == nil || key == nil {
+		return KEY_NOT_FOUND_ERROR
 	}
 
 	leaf, err := t.findLeaf(key)
@@ -328,58 +1072,116 @@ func (t *DiskBTree) Update(key, newValue []byte) error {
 		return KEY_NOT_FOUND_ERROR
 	}
 
-	leaf.Pointers[idx] = newValue
+	// Nodes are kept in the buffer pool, so they can't share memory with the caller.
+	key, newValue = bytes.Clone(key), bytes.Clone(newValue)
+	pointer, err := t.makeLeafPointer(key, newValue)
+	if err != nil {
+		return err
+	}
+
+	oldPointer := leaf.Pointers[idx]
+	leaf.Pointers[idx] = pointer
+	if t.fits(leaf) {
+		err = t.writeNode(leaf)
+	} else {
+		// The grown value doesn't fit in the leaf anymore. We take the entry out
+		// and insert it again to split the leaf. The parent keys don't need to be
+		// updated since the same key goes back in.
+		for i := uint16(idx + 1); i < leaf.Numkeys; i++ {
+			leaf.Keys[i-1] = leaf.Keys[i]
+			leaf.Pointers[i-1] = leaf.Pointers[i]
+		}
+
+		leaf.Numkeys--
+		leaf.Keys[leaf.Numkeys] = nil
+		leaf.Pointers[leaf.Numkeys] = nil
+		err = t.recursivelySplitAndInsert(leaf, key, pointer)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// The old value is freed only after the new one is in place.
+	err = t.freeLeafPointer(oldPointer)
+	if err != nil {
+		return err
+	}
 
-	return t.writeNode(leaf.ToBytes(), leaf.Ptr)
+	return t.writeMasterPage()
 }
 
-func (t *DiskBTree) Insert(key, value []byte) error {
+func (t *DiskBTree) Insert(key, value []byte) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err = t.replayFailedCommit()
+	if err != nil {
+		return err
+	}
+
+	t.beginWrite()
+	defer func() { err = t.finishWrite(err) }()
+
 	if key == nil || value == nil {
 		return INVALID_DATA_ERROR
 	}
 
-	if len(key) > math.MaxUint16 {
+	if len(key) > t.maxKeySize() {
 		return KEY_SIZE_TOO_LARGE
 	}
 
+	// Nodes are kept in the buffer pool, so they can't share memory with the caller.
+	key, value = bytes.Clone(key), bytes.Clone(value)
+
 	if t.masterPage == nil {
-		rootNode := makeLeaf(m_MASTER_PAGE_SIZE)
+		rootNode := t.makeLeaf(m_DATA_OFFSET)
 		rootNode.Keys[0] = key
-		rootNode.Pointers[0] = value
 		rootNode.Numkeys++
-		rootNode.Keysize = uint16(len(key))
-		t.keySize = len(key)
 
-		t.masterPage = &MasterPage{
-			root:      rootNode.Ptr,
-			pageCount: 1,
+		t.masterPage = t.newMasterPage(rootNode.Ptr)
+		t.masterPage.entryCount = 1
+		pointer, err := t.makeLeafPointer(key, value)
+		if err != nil {
+			t.masterPage = nil
+			return err
 		}
-		err := t.writeMasterPage()
+
+		rootNode.Pointers[0] = pointer
+		err = t.writeMasterPage()
 		if err != nil {
 			return err
 		}
 
-		return t.writeNode(rootNode.ToBytes(), rootNode.Ptr)
+		return t.writeNode(rootNode)
 	}
 
 	leaf, err := t.findLeaf(key)
-	if err == nil {
-		idx := getKeyIndex(leaf, key)
-		if idx > -1 {
-			return KEY_ALREADY_EXISTS_ERROR
-		}
+	if err != nil {
+		return err
+	}
+
+	if getKeyIndex(leaf, key) > -1 {
+		return KEY_ALREADY_EXISTS_ERROR
+	}
+
+	pointer, err := t.makeLeafPointer(key, value)
+	if err != nil {
+		return err
 	}
 
-	if len(key) != t.keySize {
-		return INVALID_KEY_SIZE_ERROR
+	if t.canInsert(leaf, key, pointer) {
+		insertIntoNode(leaf, key, pointer)
+		err = t.writeNode(leaf)
+	} else {
+		err = t.recursivelySplitAndInsert(leaf, key, pointer)
 	}
 
-	if leaf.Numkeys < m_ORDER-1 {
-		insertIntoNode(leaf, key, value)
-		return t.writeNode(leaf.ToBytes(), leaf.Ptr)
+	if err != nil {
+		return err
 	}
 
-	return t.recursivelySplitAndInsert(leaf, key, value)
+	t.masterPage.entryCount++
+	return t.writeMasterPage()
 }
 
 func (t *DiskBTree) findLeaf(key []byte) (*DiskBTreeNode, error) {
@@ -413,30 +1215,29 @@ func (t *DiskBTree) findLeaf(key []byte) (*DiskBTreeNode, error) {
 }
 
 func (t *DiskBTree) newPagePtr() uint64 {
-	return m_MASTER_PAGE_SIZE + t.masterPage.pageCount*m_PAGE_SIZE
+	return m_DATA_OFFSET + t.masterPage.pageCount*uint64(t.pageSize)
 }
 
 func (t *DiskBTree) recursivelySplitAndInsert(node *DiskBTreeNode, key []byte, pointer interface{}) error {
 	var newNode *DiskBTreeNode
-	newNodePtr := t.newPagePtr()
+	newNodePtr, err := t.allocatePage()
+	if err != nil {
+		return err
+	}
 
-	// Everytime we cann newPagePtr, we need to increment the page count
-	// to avoid getting the same ptr twice.
-	t.masterPage.pageCount++
 	if node.IsLeaf {
-		newNode = makeLeaf(newNodePtr)
+		newNode = t.makeLeaf(newNodePtr)
 		newNode.Next = node.Next
 		newNode.Prev = node.Ptr
 		node.Next = newNode.Ptr
 	} else {
-		newNode = makeNode(newNodePtr)
+		newNode = t.makeNode(newNodePtr)
 	}
 
-	newNode.Keysize = uint16(t.keySize)
 	newNode.Parent = node.Parent
 	tempNode := &DiskBTreeNode{
-		Keys:     make([][]byte, m_ORDER),
-		Pointers: make([]interface{}, m_ORDER+1),
+		Keys:     make([][]byte, node.Numkeys+1),
+		Pointers: make([]interface{}, node.Numkeys+2),
 		IsLeaf:   node.IsLeaf,
 		Numkeys:  node.Numkeys,
 	}
@@ -452,11 +1253,25 @@ func (t *DiskBTree) recursivelySplitAndInsert(node *DiskBTreeNode, key []byte, p
 
 	// We don't want to write to disk since this is just a temp node.
 	insertIntoNode(tempNode, key, pointer)
+	splitIdx, err := t.splitIndex(tempNode)
+	nodeFits := true
+	if err == NODE_SPLIT_ERROR && node.IsLeaf {
+		// The entries of a compressed leaf might only compress well together. node
+		// is split again once newNode is in the tree if the halves don't fit.
+		splitIdx, err = t.unevenSplitIndex(tempNode)
+		nodeFits = false
+	}
+
+	if err != nil {
+		return err
+	}
+
+	growNode(newNode, tempNode.Numkeys-splitIdx)
 	// Reset numkeys to reflect new content.
 	node.Numkeys = 0
-	node.Keys = make([][]byte, m_ORDER-1)
-	node.Pointers = make([]interface{}, m_ORDER)
-	for i = 0; i < m_ORDER_HALF; i++ {
+	node.Keys = make([][]byte, splitIdx+1)
+	node.Pointers = make([]interface{}, splitIdx+2)
+	for i = 0; i < splitIdx; i++ {
 		node.Keys[i] = tempNode.Keys[i]
 		node.Pointers[i] = tempNode.Pointers[i]
 		node.Numkeys++
@@ -470,13 +1285,13 @@ func (t *DiskBTree) recursivelySplitAndInsert(node *DiskBTreeNode, key []byte, p
 		nodePointerAdjustment = 1
 	}
 
-	for i = m_ORDER_HALF; i < m_ORDER; i++ {
+	for i = splitIdx; i < tempNode.Numkeys; i++ {
 		if node.IsLeaf {
-			newNode.Keys[i-m_ORDER_HALF] = tempNode.Keys[i]
+			newNode.Keys[i-splitIdx] = tempNode.Keys[i]
 			newNode.Numkeys++
 		} else {
-			if i > m_ORDER_HALF {
-				newNode.Keys[i-m_ORDER_HALF-1] = tempNode.Keys[i]
+			if i > splitIdx {
+				newNode.Keys[i-splitIdx-1] = tempNode.Keys[i]
 				newNode.Numkeys++
 			}
 
@@ -491,26 +1306,49 @@ func (t *DiskBTree) recursivelySplitAndInsert(node *DiskBTreeNode, key []byte, p
 			}
 
 			childNode.Parent = newNode.Ptr
-			err = t.writeNode(childNode.ToBytes(), childNode.Ptr)
+			err = t.writeNode(childNode)
 			if err != nil {
 				return err
 			}
 		}
-		newNode.Pointers[i-m_ORDER_HALF] = tempNode.Pointers[i+nodePointerAdjustment]
+		newNode.Pointers[i-splitIdx] = tempNode.Pointers[i+nodePointerAdjustment]
+	}
+
+	if node.IsLeaf && newNode.Next != 0 {
+		// The leaf after node needs to point back to newNode since it's now between them.
+		nextLeaf, err := t.readNode(newNode.Next)
+		if err != nil {
+			return err
+		}
+
+		nextLeaf.Prev = newNode.Ptr
+		err = t.writeNode(nextLeaf)
+		if err != nil {
+			return err
+		}
+	}
+
+	keyToAddToParent := tempNode.Keys[splitIdx]
+	if node.IsLeaf {
+		// Non leaf nodes only need a key that separates the two leaves, which
+		// is usually much shorter than the first key of newNode.
+		keyToAddToParent = separator(node.Keys[node.Numkeys-1], newNode.Keys[0])
 	}
 
 	if node.Ptr == t.masterPage.root {
 		// masterpage, node and newNode are written to disk inside splitRootAndInsert
-		return t.splitRootAndInsert(node, newNode, tempNode.Keys[m_ORDER_HALF])
+		return t.splitRootAndInsert(node, newNode, keyToAddToParent)
 	}
 
 	// We need to write node and newNode to disk to persist changes
-	err := t.writeNode(node.ToBytes(), node.Ptr)
-	if err != nil {
-		return err
+	if nodeFits {
+		err = t.writeNode(node)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = t.writeNode(newNode.ToBytes(), newNode.Ptr)
+	err = t.writeNode(newNode)
 	if err != nil {
 		return err
 	}
@@ -525,59 +1363,72 @@ func (t *DiskBTree) recursivelySplitAndInsert(node *DiskBTreeNode, key []byte, p
 		return err
 	}
 
-	if nodeParent.Numkeys < m_ORDER-1 {
-		if node.IsLeaf {
-			insertIntoNode(nodeParent, newNode.Keys[0], newNode)
-		} else {
-			insertIntoNode(nodeParent, tempNode.Keys[m_ORDER_HALF], newNode)
-		}
+	if t.canInsert(nodeParent, keyToAddToParent, newNode) {
+		insertIntoNode(nodeParent, keyToAddToParent, newNode)
+		err = t.writeNode(nodeParent)
+	} else {
+		err = t.recursivelySplitAndInsert(nodeParent, keyToAddToParent, newNode)
+	}
 
-		return t.writeNode(nodeParent.ToBytes(), nodeParent.Ptr)
+	if err != nil || nodeFits {
+		return err
 	}
 
-	if node.IsLeaf {
-		return t.recursivelySplitAndInsert(nodeParent, newNode.Keys[0], newNode)
+	// Splitting the parent may have moved node to another parent.
+	oldNode, err := t.readNode(node.Ptr)
+	if err != nil {
+		return err
 	}
 
-	return t.recursivelySplitAndInsert(nodeParent, tempNode.Keys[m_ORDER_HALF], newNode)
+	node.Parent = oldNode.Parent
+	return t.writeOrSplit(node)
 }
 
-func (t *DiskBTree) splitRootAndInsert(node, newNode *DiskBTreeNode, nonLeafKeyToAddToParent []byte) error {
-	newParent := makeNode(t.newPagePtr())
-	t.masterPage.pageCount++
-	if node.IsLeaf {
-		newParent.Keys[0] = newNode.Keys[0]
-	} else {
-		newParent.Keys[0] = nonLeafKeyToAddToParent
+func (t *DiskBTree) splitRootAndInsert(node, newNode *DiskBTreeNode, keyToAddToParent []byte) error {
+	newParentPtr, err := t.allocatePage()
+	if err != nil {
+		return err
 	}
 
+	newParent := t.makeNode(newParentPtr)
+	newParent.Keys[0] = keyToAddToParent
 	newParent.Pointers[0] = node.Ptr
 	newParent.Pointers[1] = newNode.Ptr
 	newParent.Numkeys++
-	newParent.Keysize = uint16(t.keySize)
 	node.Parent = newParent.Ptr
 	newNode.Parent = newParent.Ptr
 
-	err := t.writeNode(newParent.ToBytes(), newParent.Ptr)
+	err = t.writeNode(newParent)
 	if err != nil {
 		return err
 	}
 
-	err = t.writeNode(node.ToBytes(), node.Ptr)
+	err = t.writeNode(newNode)
 	if err != nil {
 		return err
 	}
 
-	err = t.writeNode(newNode.ToBytes(), newNode.Ptr)
+	t.masterPage.root = newParent.Ptr
+	err = t.writeMasterPage()
 	if err != nil {
 		return err
 	}
 
-	t.masterPage.root = newParent.Ptr
-	return t.writeMasterPage()
+	// node is written last since it's split again if it doesn't fit in a page.
+	return t.writeOrSplit(node)
 }
 
-func (t *DiskBTree) Delete(key []byte) error {
+func (t *DiskBTree) Delete(key []byte) (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err = t.replayFailedCommit()
+	if err != nil {
+		return err
+	}
+
+	t.beginWrite()
+	defer func() { err = t.finishWrite(err) }()
+
 	if t.masterPage == nil || key == nil {
 		return KEY_NOT_FOUND_ERROR
 	}
@@ -592,7 +1443,24 @@ func (t *DiskBTree) Delete(key []byte) error {
 		return KEY_NOT_FOUND_ERROR
 	}
 
-	return t.deleteEntry(leaf, key, leaf.Pointers[idx])
+	pointer := leaf.Pointers[idx]
+	err = t.deleteEntry(leaf, key, pointer)
+	if err != nil {
+		return err
+	}
+
+	// The master page is gone if the last entry was deleted.
+	if t.masterPage == nil {
+		return nil
+	}
+
+	err = t.freeLeafPointer(pointer)
+	if err != nil {
+		return err
+	}
+
+	t.masterPage.entryCount--
+	return t.writeMasterPage()
 }
 
 func (t *DiskBTree) deleteEntry(node *DiskBTreeNode, key []byte, pointer interface{}) error {
@@ -602,13 +1470,11 @@ func (t *DiskBTree) deleteEntry(node *DiskBTreeNode, key []byte, pointer interfa
 	}
 
 	if node.Ptr == t.masterPage.root {
-		return t.adjustRoot()
+		return t.adjustRoot(node)
 	}
 
-	minKeys := uint16(m_ORDER_HALF - 1)
-	// We subtracted 1 to avoid '>='
-	if node.Numkeys > minKeys-1 {
-		return nil
+	if !t.isUnderfull(node) {
+		return t.writeOrSplit(node)
 	}
 
 	siblingIdx, err := t.getSiblingIndex(node)
@@ -629,7 +1495,6 @@ func (t *DiskBTree) deleteEntry(node *DiskBTreeNode, key []byte, pointer interfa
 	// For example, if a node and its right sibling are being merged, k_prime is
 	// the key from the parent that previously separated these two nodes.
 	// This key will be brought down to the merging nodes.
-	// TODO: group parent writes to avoid writing multiple times.
 	nodeParent, err := t.readNode(node.Parent)
 	if err != nil {
 		return err
@@ -646,12 +1511,20 @@ func (t *DiskBTree) deleteEntry(node *DiskBTreeNode, key []byte, pointer interfa
 		return err
 	}
 
-	if sibling.Numkeys > minKeys {
+	isLeftSibling := siblingIdx < nodeIdx
+
+	if t.canLend(node, sibling, nodeParent, isLeftSibling, kPrimeIdx) {
 		// here boiz
-		return t.borrowFromSibling(node, sibling, siblingIdx < nodeIdx, kPrime, kPrimeIdx)
+		return t.borrowFromSibling(node, sibling, isLeftSibling, kPrime, kPrimeIdx)
 	}
 
-	return t.mergeNodes(node, sibling, siblingIdx < nodeIdx, kPrime)
+	// Nodes are filled by bytes, so two of them might not fit in one page.
+	// The node is left with fewer keys than usual in that case.
+	if !t.canMerge(node, sibling, kPrime) {
+		return t.writeOrSplit(node)
+	}
+
+	return t.mergeNodes(node, sibling, isLeftSibling, kPrime)
 }
 
 func (t *DiskBTree) getSiblingIndex(node *DiskBTreeNode) (int, error) {
@@ -671,14 +1544,9 @@ func (t *DiskBTree) getSiblingIndex(node *DiskBTreeNode) (int, error) {
 	return siblingIdx, nil
 }
 
-func (t *DiskBTree) adjustRoot() error {
-	rootNode, err := t.readNode(t.masterPage.root)
-	if err != nil {
-		return err
-	}
-
+func (t *DiskBTree) adjustRoot(rootNode *DiskBTreeNode) error {
 	if rootNode.Numkeys > 0 {
-		return nil
+		return t.writeOrSplit(rootNode)
 	}
 
 	if !rootNode.IsLeaf {
@@ -692,10 +1560,14 @@ func (t *DiskBTree) adjustRoot() error {
 			return err
 		}
 
-		// TODO: handle node deletion and pageCount decrementing
 		t.masterPage.root = newRootPtr
 		newRoot.Parent = 0
-		err = t.writeNode(newRoot.ToBytes(), newRootPtr)
+		err = t.writeNode(newRoot)
+		if err != nil {
+			return err
+		}
+
+		err = t.freePage(rootNode.Ptr)
 		if err != nil {
 			return err
 		}
@@ -705,13 +1577,19 @@ func (t *DiskBTree) adjustRoot() error {
 
 	// We set the db file size to 0 i.e. deleting everything since the db is now empty.
 	// We want to avoid writing data with all zeros to avoid enc key prediction.
-	err = t.dbFile.Truncate(0)
+	t.pendingPages = make(map[uint64][]byte)
+	t.bufferPool.clear()
+	t.resetPageTable()
+	err := t.dbFile.Truncate(0)
 	if err != nil {
 		return err
 	}
 
-	_, err = t.dbFile.Seek(0, io.SeekStart)
-	return err
+	// Emptying the file can't be undone.
+	t.masterPage = nil
+	t.beginWrite()
+
+	return nil
 }
 
 func (t *DiskBTree) borrowFromSibling(node, sibling *DiskBTreeNode, isLeftSibling bool, kPrime []byte, kPrimeIdx int) error {
@@ -720,6 +1598,8 @@ func (t *DiskBTree) borrowFromSibling(node, sibling *DiskBTreeNode, isLeftSiblin
 		return err
 	}
 
+	growNode(node, node.Numkeys+1)
+
 	if !node.IsLeaf {
 		if isLeftSibling {
 			// Sibling is on the left.
@@ -752,6 +1632,10 @@ func (t *DiskBTree) borrowFromSibling(node, sibling *DiskBTreeNode, isLeftSiblin
 			}
 
 			borrowdChild.Parent = node.Ptr
+			err = t.writeNode(borrowdChild)
+			if err != nil {
+				return err
+			}
 
 			// Update the parent key with the key to be removed from sibling.
 			nodeParent.Keys[kPrimeIdx] = sibling.Keys[sibling.Numkeys-1]
@@ -781,7 +1665,11 @@ func (t *DiskBTree) borrowFromSibling(node, sibling *DiskBTreeNode, isLeftSiblin
 				return err
 			}
 
-			borrowdChild.Parent = node.Parent
+			borrowdChild.Parent = node.Ptr
+			err = t.writeNode(borrowdChild)
+			if err != nil {
+				return err
+			}
 
 			// Update the parent key with the key to be removed from sibling.
 			nodeParent.Keys[kPrimeIdx] = sibling.Keys[0]
@@ -809,60 +1697,71 @@ func (t *DiskBTree) borrowFromSibling(node, sibling *DiskBTreeNode, isLeftSiblin
 	} else {
 
 		// Leaf node operations
-		if isLeftSibling {
-			// Sibling is on the left.
-			// Shifting node's keys & pointers to the right to make room for the
-			// key & pointer to be inserted.
-			for i := node.Numkeys; i > 0; i-- {
-				node.Keys[i] = node.Keys[i-1]
-				node.Pointers[i] = node.Pointers[i-1]
-			}
+		// Leaves are filled by bytes, so one entry might not be enough. We keep
+		// borrowing until node isn't underfull or sibling can't lend anymore.
+		for {
+			if isLeftSibling {
+				// Sibling is on the left.
+				// Shifting node's keys & pointers to the right to make room for the
+				// key & pointer to be inserted.
+				for i := node.Numkeys; i > 0; i-- {
+					node.Keys[i] = node.Keys[i-1]
+					node.Pointers[i] = node.Pointers[i-1]
+				}
 
-			// Since this is a leaf node, we don't need to use `kPrime`.
-			node.Keys[0] = sibling.Keys[sibling.Numkeys-1]
-			node.Pointers[0] = sibling.Pointers[sibling.Numkeys-1]
-			// We need to update the parent's key to the newly inserted key
-			// since it'll be placed in index 0.
-			nodeParent.Keys[kPrimeIdx] = node.Keys[0]
-			node.Numkeys++
-			// Set the borrowed key & pointer to nil.
-			sibling.Keys[sibling.Numkeys-1] = nil
-			sibling.Pointers[sibling.Numkeys-1] = nil
-			sibling.Numkeys--
+				// Since this is a leaf node, we don't need to use `kPrime`.
+				node.Keys[0] = sibling.Keys[sibling.Numkeys-1]
+				node.Pointers[0] = sibling.Pointers[sibling.Numkeys-1]
+				node.Numkeys++
+				// Set the borrowed key & pointer to nil.
+				sibling.Keys[sibling.Numkeys-1] = nil
+				sibling.Pointers[sibling.Numkeys-1] = nil
+				sibling.Numkeys--
+				// We need to update the parent's key since the newly inserted key
+				// is placed in index 0.
+				nodeParent.Keys[kPrimeIdx] = separator(sibling.Keys[sibling.Numkeys-1], node.Keys[0])
 
-		} else {
+			} else {
 
-			// Sibling is on the right.
-			node.Keys[node.Numkeys] = sibling.Keys[0]
-			node.Pointers[node.Numkeys] = sibling.Pointers[0]
-			// Updating the key is required since sibling's index 0 key is changing.
-			// Sibling's index 1 key will become index 0 key after shifting.
-			nodeParent.Keys[kPrimeIdx] = sibling.Keys[1]
-			node.Numkeys++
-			// Shifting sibling's keys & pointers to the left by one.
-			for i := uint16(0); i < sibling.Numkeys-1; i++ {
-				sibling.Keys[i] = sibling.Keys[i+1]
-				sibling.Pointers[i] = sibling.Pointers[i+1]
-				sibling.Keys[i+1] = nil
-				sibling.Pointers[i+1] = nil
+				// Sibling is on the right.
+				node.Keys[node.Numkeys] = sibling.Keys[0]
+				node.Pointers[node.Numkeys] = sibling.Pointers[0]
+				// Updating the key is required since sibling's index 0 key is changing.
+				// Sibling's index 1 key will become index 0 key after shifting.
+				nodeParent.Keys[kPrimeIdx] = separator(sibling.Keys[0], sibling.Keys[1])
+				node.Numkeys++
+				// Shifting sibling's keys & pointers to the left by one.
+				for i := uint16(0); i < sibling.Numkeys-1; i++ {
+					sibling.Keys[i] = sibling.Keys[i+1]
+					sibling.Pointers[i] = sibling.Pointers[i+1]
+					sibling.Keys[i+1] = nil
+					sibling.Pointers[i+1] = nil
+				}
+
+				sibling.Numkeys--
 			}
 
-			sibling.Numkeys--
+			if !t.isUnderfull(node) || !t.canLend(node, sibling, nodeParent, isLeftSibling, kPrimeIdx) {
+				break
+			}
+
+			growNode(node, node.Numkeys+1)
 		}
 	}
 
-	// Persist the changes to disk
-	err = t.writeNode(node.ToBytes(), node.Ptr)
+	// Persist the changes to disk. The parent is written before sibling since
+	// splitting sibling adds a key to it.
+	err = t.writeNode(node)
 	if err != nil {
 		return err
 	}
 
-	err = t.writeNode(sibling.ToBytes(), sibling.Ptr)
+	err = t.writeNode(nodeParent)
 	if err != nil {
 		return err
 	}
 
-	return t.writeNode(nodeParent.ToBytes(), nodeParent.Ptr)
+	return t.writeOrSplit(sibling)
 }
 
 func (t *DiskBTree) mergeNodes(node, sibling *DiskBTreeNode, isLeftSibling bool, kPrime []byte) error {
@@ -873,6 +1772,7 @@ func (t *DiskBTree) mergeNodes(node, sibling *DiskBTreeNode, isLeftSibling bool,
 	}
 
 	insertionIndex := sibling.Numkeys
+	growNode(sibling, sibling.Numkeys+node.Numkeys+1)
 	if !node.IsLeaf {
 		// `kPrime` needs to be added first to ensure tree balance,
 		// and to make the final sum of the keys less than pointers by 1.
@@ -898,8 +1798,7 @@ func (t *DiskBTree) mergeNodes(node, sibling *DiskBTreeNode, isLeftSibling bool,
 			}
 
 			borrowdChild.Parent = sibling.Ptr
-			// TODO: Group borrowdChildredn writes to improve performance
-			err = t.writeNode(borrowdChild.ToBytes(), borrowdChildPtr)
+			err = t.writeNode(borrowdChild)
 			if err != nil {
 				return err
 			}
@@ -920,8 +1819,7 @@ func (t *DiskBTree) mergeNodes(node, sibling *DiskBTreeNode, isLeftSibling bool,
 
 		borrowdChild.Parent = sibling.Ptr
 
-		// TODO: Group borrowdChildredn writes to improve performance
-		err = t.writeNode(borrowdChild.ToBytes(), borrowdChildPtr)
+		err = t.writeNode(borrowdChild)
 		if err != nil {
 			return err
 		}
@@ -934,15 +1832,32 @@ func (t *DiskBTree) mergeNodes(node, sibling *DiskBTreeNode, isLeftSibling bool,
 			sibling.Pointers[i] = node.Pointers[j]
 			i++
 		}
+
+		// node is being removed from the leaves list, so the leaf after it
+		// needs to point back to sibling.
+		sibling.Next = node.Next
+		if node.Next != 0 {
+			nextLeaf, err := t.readNode(node.Next)
+			if err != nil {
+				return err
+			}
+
+			nextLeaf.Prev = sibling.Ptr
+			err = t.writeNode(nextLeaf)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	sibling.Numkeys += node.Numkeys
-	err := t.writeNode(node.ToBytes(), node.Ptr)
+	// node is empty now, so its page can be reused.
+	err := t.freePage(node.Ptr)
 	if err != nil {
 		return err
 	}
 
-	err = t.writeNode(sibling.ToBytes(), sibling.Ptr)
+	err = t.writeNode(sibling)
 	if err != nil {
 		return err
 	}
@@ -952,7 +1867,24 @@ func (t *DiskBTree) mergeNodes(node, sibling *DiskBTreeNode, isLeftSibling bool,
 		return err
 	}
 
-	return t.deleteEntry(nodeParent, kPrime, node)
+	return t.deleteEntry(nodeParent, kPrime, node.Ptr)
+}
+
+// Writes `node`, or splits it if it's a compressed leaf that doesn't fit in a page
+// anymore. Removing entries from a leaf can make the rest of it compress worse.
+func (t *DiskBTree) writeOrSplit(node *DiskBTreeNode) error {
+	if t.fits(node) {
+		return t.writeNode(node)
+	}
+
+	// Like in Update, we take the last entry out and insert it again to split the leaf.
+	last := node.Numkeys - 1
+	key, pointer := node.Keys[last], node.Pointers[last]
+	node.Keys[last] = nil
+	node.Pointers[last] = nil
+	node.Numkeys--
+
+	return t.recursivelySplitAndInsert(node, key, pointer)
 }
 
 func (t *DiskBTree) removeFromNode(node *DiskBTreeNode, key []byte, pointer interface{}) error {
@@ -972,7 +1904,13 @@ func (t *DiskBTree) removeFromNode(node *DiskBTreeNode, key []byte, pointer inte
 		numPointers++
 	}
 
-	pointerIdx := getPointerIndex(node, pointer)
+	// The pointer of a key in a leaf is at the same index. Its value can't be looked
+	// up since other keys may have the same value.
+	pointerIdx := keyIdx
+	if !node.IsLeaf {
+		pointerIdx = getPointerIndex(node, pointer)
+	}
+
 	if pointerIdx < 0 {
 		return INVALID_POINTER_INDEX_ERROR
 	}
@@ -996,10 +1934,11 @@ func (t *DiskBTree) removeFromNode(node *DiskBTreeNode, key []byte, pointer inte
 			return err
 		}
 
+		// The old key still separates the nodes, so we keep it if the new one doesn't fit.
 		oldKeyIdxInParent := getKeyIndex(nodeParent, key)
-		if oldKeyIdxInParent > -1 {
+		if oldKeyIdxInParent > -1 && t.canReplaceKey(nodeParent, oldKeyIdxInParent, node.Keys[0]) {
 			nodeParent.Keys[oldKeyIdxInParent] = node.Keys[0]
-			return t.writeNode(nodeParent.ToBytes(), nodeParent.Ptr)
+			return t.writeNode(nodeParent)
 		}
 	}
 
@@ -1007,6 +1946,8 @@ func (t *DiskBTree) removeFromNode(node *DiskBTreeNode, key []byte, pointer inte
 }
 
 func (t *DiskBTree) Print(withPointers bool) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	if t.masterPage == nil {
 		fmt.Println("Tree is empty")
 		return nil
@@ -1062,6 +2003,8 @@ func (t *DiskBTree) Print(withPointers bool) error {
 }
 
 func (t *DiskBTree) PrintLeaves() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	if t.masterPage == nil {
 		fmt.Println("Tree is empty")
 		return nil
@@ -1106,6 +2049,8 @@ func (t *DiskBTree) PrintLeaves() error {
 }
 
 func (t *DiskBTree) PrintLeavesBackwards() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	if t.masterPage == nil {
 		fmt.Println("Tree is empty")
 		return nil
@@ -1117,7 +2062,7 @@ func (t *DiskBTree) PrintLeavesBackwards() error {
 	}
 
 	for !leaf.IsLeaf {
-		nonLeafNodePtr, ok := leaf.Pointers[0].(uint64)
+		nonLeafNodePtr, ok := leaf.Pointers[leaf.Numkeys].(uint64)
 		if !ok {
 			return TYPE_CONVERSION_ERROR
 		}
@@ -1144,15 +2089,17 @@ func (t *DiskBTree) PrintLeavesBackwards() error {
 		leaf = previousLeaf
 	}
 
+	fmt.Println()
+
 	return nil
 }
 
-func makeNode(ptr uint64) *DiskBTreeNode {
+func (t *DiskBTree) makeNode(ptr uint64) *DiskBTreeNode {
 	return &DiskBTreeNode{
 		Ptr:      ptr,
-		Keys:     make([][]byte, m_ORDER-1),
+		Keys:     make([][]byte, 1),
 		Numkeys:  0,
-		Pointers: make([]interface{}, m_ORDER),
+		Pointers: make([]interface{}, 2),
 		IsLeaf:   false,
 		Parent:   0,
 		Next:     0,
@@ -1160,14 +2107,223 @@ func makeNode(ptr uint64) *DiskBTreeNode {
 	}
 }
 
-func makeLeaf(ptr uint64) *DiskBTreeNode {
-	node := makeNode(ptr)
+func (t *DiskBTree) makeLeaf(ptr uint64) *DiskBTreeNode {
+	node := t.makeNode(ptr)
 	node.IsLeaf = true
 
 	return node
 }
 
+// Reports whether `key` with `pointer` fits into `node` without splitting it.
+func (t *DiskBTree) canInsert(node *DiskBTreeNode, key []byte, pointer interface{}) bool {
+	payloadSize := node.payloadSize() + entrySize(node.IsLeaf, key, pointer)
+	payloadSize -= t.prefixSavings(node.Numkeys+1, append(endKeys(node), key)...)
+	if t.nodeFits(node.Numkeys+1, payloadSize) {
+		return true
+	}
+
+	if !t.mightFit(node.IsLeaf, node.Numkeys+1, payloadSize) {
+		return false
+	}
+
+	leaf := node.clone()
+	growNode(leaf, leaf.Numkeys+1)
+	insertIntoNode(leaf, key, pointer)
+	return t.fitsCompressed(leaf)
+}
+
+// Reports whether `node` fits in one page and within the order of the tree.
+func (t *DiskBTree) fits(node *DiskBTreeNode) bool {
+	if t.nodeFits(node.Numkeys, t.payloadSize(node)) {
+		return true
+	}
+
+	return node.IsLeaf && t.fitsCompressed(node)
+}
+
+// Reports whether a node with `numKeys` keys taking up `payloadSize` bytes
+// after the header fits in one page and within the order of the tree.
+func (t *DiskBTree) nodeFits(numKeys uint16, payloadSize int) bool {
+	if t.order != 0 && numKeys > t.order-1 {
+		return false
+	}
+
+	return m_NODE_HEADER_SIZE+payloadSize <= t.pageDataSize()
+}
+
+// Returns the index to split an overflowing `node` at. Keys before the index
+// stay in node and the rest go to the new node, except in non leaf nodes where
+// the key at the index moves up to the parent.
+// Nodes are split so that both halves fit in a page and hold about the same
+// number of bytes, or the same number of keys when nodes are capped by the order.
+func (t *DiskBTree) splitIndex(node *DiskBTreeNode) (uint16, error) {
+	movedUp := uint16(0)
+	leftSize := 0
+	if !node.IsLeaf {
+		movedUp = 1
+		// The first pointer.
+		leftSize = 8
+	}
+
+	totalSize := node.payloadSize()
+	candidates := []splitCandidate{}
+	for i := uint16(1); i+movedUp < node.Numkeys; i++ {
+		leftSize += entrySize(node.IsLeaf, node.Keys[i-1], node.Pointers[i-1])
+		rightSize := totalSize - leftSize
+		if !node.IsLeaf {
+			// The pointer after the key that moves up becomes the first pointer of the new node.
+			rightSize -= m_SLOT_SIZE + m_KEY_LENGTH_SIZE + len(node.Keys[i])
+		}
+
+		rightKeys := node.Numkeys - i - movedUp
+		leftPayload := leftSize - t.prefixSavings(i, node.Keys[0], node.Keys[i-1])
+		rightPayload := rightSize - t.prefixSavings(rightKeys, node.Keys[i+movedUp], node.Keys[node.Numkeys-1])
+		if !t.mightFit(node.IsLeaf, i, leftPayload) || !t.mightFit(node.IsLeaf, rightKeys, rightPayload) {
+			continue
+		}
+
+		diff := leftPayload - rightPayload
+		if t.order != 0 {
+			diff = int(i) - int(rightKeys)
+		}
+
+		if diff < 0 {
+			diff = -diff
+		}
+
+		candidates = append(candidates, splitCandidate{idx: i, diff: diff})
+	}
+
+	// The most even split comes first. Later indexes come first on ties so
+	// that node gets the extra key.
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].diff != candidates[j].diff {
+			return candidates[i].diff < candidates[j].diff
+		}
+
+		return candidates[i].idx > candidates[j].idx
+	})
+
+	for _, candidate := range candidates {
+		if t.canSplitAt(node, candidate.idx) {
+			return candidate.idx, nil
+		}
+	}
+
+	return 0, NODE_SPLIT_ERROR
+}
+
+// Returns the index to split a leaf at when no split gives two leaves that fit in a
+// page. The new leaf gets as many entries as fit in it and the rest stay in the leaf.
+func (t *DiskBTree) unevenSplitIndex(leaf *DiskBTreeNode) (uint16, error) {
+	for i := uint16(1); i < leaf.Numkeys; i++ {
+		if t.fits(subLeaf(leaf, i, leaf.Numkeys)) {
+			return i, nil
+		}
+	}
+
+	return 0, NODE_SPLIT_ERROR
+}
+
+type splitCandidate struct {
+	idx  uint16
+	diff int
+}
+
+// Reports whether `node` holds too few keys or bytes and needs to borrow from,
+// or be merged with, a sibling.
+func (t *DiskBTree) isUnderfull(node *DiskBTreeNode) bool {
+	if t.order != 0 {
+		return node.Numkeys < t.orderHalf-1
+	}
+
+	halfPayload := (t.pageDataSize() - m_NODE_HEADER_SIZE) / 2
+	return node.Numkeys == 0 || t.payloadSize(node) < halfPayload
+}
+
+// Reports whether `sibling` can give `node` a key without becoming underfull itself
+// or making node or `parent` overflow. The key at `kPrimeIdx` in parent separates them
+// and is replaced by another key when borrowing.
+func (t *DiskBTree) canLend(node, sibling, parent *DiskBTreeNode, isLeftSibling bool, kPrimeIdx int) bool {
+	if sibling.Numkeys < 2 {
+		return false
+	}
+
+	idx := uint16(0)
+	if isLeftSibling {
+		idx = sibling.Numkeys - 1
+	}
+
+	kPrime := parent.Keys[kPrimeIdx]
+	lentSize := entrySize(node.IsLeaf, sibling.Keys[idx], sibling.Pointers[idx])
+	borrowedKey := sibling.Keys[idx]
+	newKPrime := sibling.Keys[idx]
+	if !node.IsLeaf {
+		// Non leaf nodes get kPrime instead of the key of sibling, which goes up to parent.
+		borrowedKey = kPrime
+	} else if isLeftSibling {
+		newKPrime = separator(sibling.Keys[idx-1], sibling.Keys[idx])
+	} else {
+		newKPrime = separator(sibling.Keys[0], sibling.Keys[1])
+	}
+
+	if !t.canInsert(node, borrowedKey, sibling.Pointers[idx]) {
+		return false
+	}
+
+	if !t.canReplaceKey(parent, kPrimeIdx, newKPrime) {
+		return false
+	}
+
+	if t.order != 0 {
+		return sibling.Numkeys > t.orderHalf-1
+	}
+
+	// The keys that are left in sibling after lending one.
+	first, last := sibling.Keys[1], sibling.Keys[sibling.Numkeys-1]
+	if isLeftSibling {
+		first, last = sibling.Keys[0], sibling.Keys[sibling.Numkeys-2]
+	}
+
+	siblingPayload := sibling.payloadSize() - lentSize - t.prefixSavings(sibling.Numkeys-1, first, last)
+	halfPayload := (t.pageDataSize() - m_NODE_HEADER_SIZE) / 2
+	return siblingPayload >= halfPayload
+}
+
+// Reports whether the keys of `node` and `sibling` fit in one node.
+// `kPrime` is the key that separates them in their parent.
+func (t *DiskBTree) canMerge(node, sibling *DiskBTreeNode, kPrime []byte) bool {
+	numKeys := node.Numkeys + sibling.Numkeys
+	payloadSize := node.payloadSize() + sibling.payloadSize()
+	if !node.IsLeaf {
+		// kPrime is brought down into the merged node, and only one of the
+		// first pointers stays first.
+		numKeys++
+		payloadSize += m_SLOT_SIZE + m_KEY_LENGTH_SIZE + len(kPrime)
+	}
+
+	keys := append(endKeys(node), endKeys(sibling)...)
+	payloadSize -= t.prefixSavings(numKeys, append(keys, kPrime)...)
+	if t.nodeFits(numKeys, payloadSize) {
+		return true
+	}
+
+	return t.mightFit(node.IsLeaf, numKeys, payloadSize) && t.fitsCompressed(mergedLeaf(node, sibling))
+}
+
+// Makes sure `node` has room for `numKeys` keys and their pointers.
+func growNode(node *DiskBTreeNode, numKeys uint16) {
+	if int(numKeys) > len(node.Keys) {
+		node.Keys = append(node.Keys, make([][]byte, int(numKeys)-len(node.Keys))...)
+	}
+
+	if int(numKeys)+1 > len(node.Pointers) {
+		node.Pointers = append(node.Pointers, make([]interface{}, int(numKeys)+1-len(node.Pointers))...)
+	}
+}
+
 func insertIntoNode(node *DiskBTreeNode, key []byte, pointer interface{}) {
+	growNode(node, node.Numkeys+1)
 	insertionIndex := getInsertionIndex(node, key)
 	nonLeafNodeAdjustment := uint16(0)
 	if !node.IsLeaf {
@@ -1190,6 +2346,17 @@ func insertIntoNode(node *DiskBTreeNode, key []byte, pointer interface{}) {
 	node.Numkeys++
 }
 
+// Returns the shortest key that is greater than `left` and not greater than `right`,
+// which is all a non leaf node needs to separate them. `left` must be less than `right`.
+func separator(left, right []byte) []byte {
+	i := 0
+	for i < len(left) && left[i] == right[i] {
+		i++
+	}
+
+	return bytes.Clone(right[:i+1])
+}
+
 // Gets the index that `key` needs to be inserted into.
 func getInsertionIndex(node *DiskBTreeNode, key []byte) uint16 {
 	insertionIndex := uint16(0)
@@ -1232,10 +2399,11 @@ func getPointerIndex(node *DiskBTreeNode, pointer interface{}) int {
 	}
 
 	for i := 0; i < int(node.Numkeys)+nonLeafNodeAdjustment; i++ {
-		// We do this because pointer can either be []byte or uint64. []byte can't be compared using ==
+		// We do this because pointer can either be []byte, overflowValue or uint64. []byte can't be compared using ==
 		val, ok := pointer.([]byte)
 		if ok {
-			if bytes.Compare(node.Pointers[i].([]byte), val) == 0 {
+			nodeVal, ok := node.Pointers[i].([]byte)
+			if ok && bytes.Compare(nodeVal, val) == 0 {
 				idx = i
 				break
 			}
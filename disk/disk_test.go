@@ -1,11 +1,17 @@
 package disk
 
 import (
+	"bytes"
 	rand "crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	mathRand "math/rand"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
@@ -14,14 +20,47 @@ import (
 const MULTIPLE_TEST_COUNT = 50
 const RAND_KEY_LEN = 16
 
+// The trees use a small order to make sure the tests exercise splitting and merging.
 func getTree() (*DiskBTree, error) {
+	return getTreeWithOptions(Options{Order: 4})
+}
+
+func getTreeWithOptions(opts Options) (*DiskBTree, error) {
 	memFS := afero.NewMemMapFs()
 	f, err := memFS.Create("memfile")
 	if err != nil {
 		return nil, err
 	}
 
-	return newTreeFromFile(f)
+	walFile, err := memFS.Create("memfile-wal")
+	if err != nil {
+		return nil, err
+	}
+
+	return newTreeFromFiles(f, walFile, opts)
+}
+
+func reopenTree(tree *DiskBTree, memFS afero.Fs) (*DiskBTree, error) {
+	return reopenTreeWithOptions(tree, memFS, Options{})
+}
+
+func reopenTreeWithOptions(tree *DiskBTree, memFS afero.Fs, opts Options) (*DiskBTree, error) {
+	err := tree.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := memFS.OpenFile("memfile", os.O_RDWR, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	walFile, err := memFS.OpenFile("memfile-wal", os.O_RDWR|os.O_CREATE, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTreeFromFiles(f, walFile, opts)
 }
 
 func TestFindNilRoot(t *testing.T) {
@@ -72,14 +111,373 @@ func TestInsertVariableKeySize(t *testing.T) {
 	assert.Nil(t, err)
 	defer tree.Close()
 
-	key1, key2, val := []byte("1"), []byte("key 2"), []byte("v1")
-	err = tree.Insert(key1, val)
+	keys := [][]byte{[]byte("1"), []byte("key 2"), []byte(""), bytes.Repeat([]byte("k"), 80)}
+	for i, key := range keys {
+		err = tree.Insert(key, []byte("v"+fmt.Sprint(i)))
+		assert.Nil(t, err)
+	}
+
+	for i, key := range keys {
+		res, err := tree.Find(key)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v"+fmt.Sprint(i)), res)
+	}
+}
+
+func TestVariableLengthKeys(t *testing.T) {
+	for _, opts := range []Options{{Order: 4}, {PageSize: m_MIN_PAGE_SIZE}, {PageSize: m_MIN_PAGE_SIZE, PrefixCompression: true}} {
+		tree, err := getTreeWithOptions(opts)
+		assert.Nil(t, err)
+
+		maxKeySize := tree.maxKeySize()
+		values := make(map[string][]byte)
+		for i := 0; i < MULTIPLE_TEST_COUNT*4; i++ {
+			key := make([]byte, mathRand.Intn(maxKeySize+1))
+			_, err = rand.Read(key)
+			assert.Nil(t, err)
+			if _, ok := values[string(key)]; ok {
+				err = tree.Delete(key)
+				delete(values, string(key))
+			} else {
+				value := bytes.Repeat([]byte{byte(i)}, mathRand.Intn(m_MIN_PAGE_SIZE))
+				err = tree.Insert(key, value)
+				values[string(key)] = value
+			}
+
+			assert.Nil(t, err)
+		}
+
+		assertTreeIsValid(t, tree)
+		for key, value := range values {
+			res, err := tree.Find([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, res)
+		}
+
+		for key := range values {
+			err = tree.Delete([]byte(key))
+			assert.Nil(t, err)
+		}
+
+		assert.EqualValues(t, 0, tree.Count())
+		assert.Equal(t, KEY_SIZE_TOO_LARGE, tree.Insert(make([]byte, maxKeySize+1), []byte("v")))
+		tree.Close()
+	}
+}
+
+func TestPrefixCompression(t *testing.T) {
+	prefix := bytes.Repeat([]byte("a/long/shared/prefix/"), 4)
+	pageCounts := []uint64{}
+	for _, compress := range []bool{false, true} {
+		memFS := afero.NewMemMapFs()
+		f, err := memFS.Create("memfile")
+		assert.Nil(t, err)
+		opts := Options{PageSize: m_MIN_PAGE_SIZE, PrefixCompression: compress}
+		tree, err := newTreeFromFileWithOptions(f, opts)
+		assert.Nil(t, err)
+
+		values := make(map[string][]byte)
+		for i := 0; i < MULTIPLE_TEST_COUNT*4; i++ {
+			key := append(append([]byte{}, prefix...), getPaddedKey("4", mathRand.Intn(MULTIPLE_TEST_COUNT*2))...)
+			if _, ok := values[string(key)]; ok && i%3 == 0 {
+				err = tree.Delete(key)
+				delete(values, string(key))
+			} else if !ok {
+				value := []byte{byte(i)}
+				err = tree.Insert(key, value)
+				values[string(key)] = value
+			}
+
+			assert.Nil(t, err)
+		}
+
+		if compress {
+			// Reopening without the option keeps the setting of the tree.
+			tree, err = reopenTree(tree, memFS)
+		} else {
+			_, err = reopenTreeWithOptions(tree, memFS, Options{PrefixCompression: true})
+			assert.Equal(t, PREFIX_COMPRESSION_MISMATCH_ERROR, err)
+			tree, err = reopenTree(tree, memFS)
+		}
+
+		assert.Nil(t, err)
+		assert.Equal(t, compress, tree.prefixCompression)
+
+		assertTreeIsValid(t, tree)
+		assert.EqualValues(t, len(values), tree.Count())
+		for key, value := range values {
+			res, err := tree.Find([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, res)
+		}
+
+		pageCounts = append(pageCounts, tree.masterPage.pageCount)
+		tree.Close()
+	}
+
+	assert.Less(t, pageCounts[1], pageCounts[0])
+}
+
+func TestSuffixTruncation(t *testing.T) {
+	tree, err := getTreeWithOptions(Options{})
 	assert.Nil(t, err)
-	assert.Equal(t, len(key1), tree.keySize)
+	defer tree.Close()
 
-	err = tree.Insert(key2, val)
-	assert.NotNil(t, err)
-	assert.Equal(t, len(key1), tree.keySize)
+	keys := make([][]byte, MULTIPLE_TEST_COUNT)
+	for i, n := range mathRand.Perm(MULTIPLE_TEST_COUNT) {
+		keys[i] = append(getPaddedKey("4", n), bytes.Repeat([]byte("x"), 200)...)
+		err = tree.Insert(keys[i], []byte("v"))
+		assert.Nil(t, err)
+	}
+
+	// Separators only need the leading digits of the keys, not the padding.
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		node, err := tree.readNode(ptr)
+		assert.Nil(t, err)
+		if node.IsLeaf {
+			return
+		}
+
+		for i := uint16(0); i < node.Numkeys; i++ {
+			assert.LessOrEqual(t, len(node.Keys[i]), 4)
+		}
+
+		for i := uint16(0); i <= node.Numkeys; i++ {
+			walk(node.Pointers[i].(uint64))
+		}
+	}
+	walk(tree.masterPage.root)
+
+	for i, key := range keys {
+		if i%2 == 0 {
+			err = tree.Delete(key)
+			assert.Nil(t, err)
+		}
+	}
+
+	assertTreeIsValid(t, tree)
+	for i, key := range keys {
+		res, err := tree.Find(key)
+		if i%2 == 0 {
+			assert.Equal(t, KEY_NOT_FOUND_ERROR, err)
+			continue
+		}
+
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v"), res)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	getValue := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"name":"entity-%d","tags":["alpha","beta","gamma"],"status":"active","owner":"tenant-%d"}`, i, i, i%4))
+	}
+
+	pageCounts := []uint64{}
+	for _, compressor := range []Compressor{nil, DeflateCompressor{}} {
+		memFS := afero.NewMemMapFs()
+		f, err := memFS.Create("memfile")
+		assert.Nil(t, err)
+		opts := Options{PageSize: 2 * m_MIN_PAGE_SIZE, Compressor: compressor}
+		tree, err := newTreeFromFileWithOptions(f, opts)
+		assert.Nil(t, err)
+
+		for _, i := range mathRand.Perm(MULTIPLE_TEST_COUNT * 4) {
+			err = tree.Insert(getPaddedKey("4", i), getValue(i))
+			assert.Nil(t, err)
+		}
+
+		// Deflate is used by default for trees compressed with it.
+		tree, err = reopenTree(tree, memFS)
+		assert.Nil(t, err)
+		assertTreeIsValid(t, tree)
+		for i := 0; i < MULTIPLE_TEST_COUNT*4; i++ {
+			res, err := tree.Find(getPaddedKey("4", i))
+			assert.Nil(t, err)
+			assert.Equal(t, getValue(i), res)
+		}
+
+		pageCounts = append(pageCounts, tree.masterPage.pageCount)
+		for i := 0; i < MULTIPLE_TEST_COUNT*4; i += 2 {
+			err = tree.Delete(getPaddedKey("4", i))
+			assert.Nil(t, err)
+		}
+
+		assertTreeIsValid(t, tree)
+		assert.EqualValues(t, MULTIPLE_TEST_COUNT*2, tree.Count())
+		tree.Close()
+	}
+
+	assert.Less(t, pageCounts[1], pageCounts[0])
+}
+
+type testCompressor struct {
+	DeflateCompressor
+	id uint8
+}
+
+func (c testCompressor) ID() uint8 {
+	return c.id
+}
+
+func TestCompressionOfExistingTree(t *testing.T) {
+	_, err := getTreeWithOptions(Options{Compressor: testCompressor{id: 0}})
+	assert.Equal(t, INVALID_COMPRESSOR_ERROR, err)
+
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+	tree, err := newTreeFromFileWithOptions(f, Options{PageSize: 2 * m_MIN_PAGE_SIZE})
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("compressible "), 12)
+	for i := 0; i < MULTIPLE_TEST_COUNT*2; i++ {
+		err = tree.Insert(getPaddedKey("4", i), value)
+		assert.Nil(t, err)
+	}
+
+	// Leaves written before compression was turned on are read as they are.
+	opts := Options{Compressor: testCompressor{id: 2}}
+	tree, err = reopenTreeWithOptions(tree, memFS, opts)
+	assert.Nil(t, err)
+	for i := MULTIPLE_TEST_COUNT * 2; i < MULTIPLE_TEST_COUNT*4; i++ {
+		err = tree.Insert(getPaddedKey("4", i), value)
+		assert.Nil(t, err)
+	}
+
+	_, err = reopenTree(tree, memFS)
+	assert.Equal(t, COMPRESSOR_MISMATCH_ERROR, err)
+
+	_, err = reopenTreeWithOptions(tree, memFS, Options{Compressor: DeflateCompressor{}})
+	assert.Equal(t, COMPRESSOR_MISMATCH_ERROR, err)
+
+	tree, err = reopenTreeWithOptions(tree, memFS, opts)
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	assertTreeIsValid(t, tree)
+	for i := 0; i < MULTIPLE_TEST_COUNT*4; i++ {
+		res, err := tree.Find(getPaddedKey("4", i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, res)
+	}
+
+	pageTypes := make(map[byte]int)
+	for i := uint64(0); i < tree.masterPage.pageCount; i++ {
+		pageBytes, err := tree.readPage(m_DATA_OFFSET + i*uint64(tree.pageSize))
+		assert.Nil(t, err)
+		pageTypes[pageBytes[0]]++
+	}
+
+	assert.NotZero(t, pageTypes[m_LEAF_PAGE])
+	assert.NotZero(t, pageTypes[m_COMPRESSED_LEAF_PAGE])
+}
+
+// Values that only compress well because they repeat across entries might not fit
+// in a page anymore when a leaf is split in two, or when some of them are removed.
+func TestCompressionOfRepeatedValues(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		tree, err := getTreeWithOptions(Options{PageSize: 4096, Compressor: DeflateCompressor{}})
+		assert.Nil(t, err)
+
+		rng := mathRand.New(mathRand.NewSource(seed))
+		values := make([][]byte, 5)
+		for i := range values {
+			values[i] = make([]byte, 700)
+			rng.Read(values[i])
+		}
+
+		entries := make(map[int][]byte)
+		for _, i := range rng.Perm(MULTIPLE_TEST_COUNT * 4) {
+			entries[i] = values[rng.Intn(len(values))]
+			err = tree.Insert(getPaddedKey("4", i), entries[i])
+			if !assert.Nil(t, err, "seed %d key %d", seed, i) {
+				return
+			}
+		}
+
+		assertTreeIsValid(t, tree)
+		for i, value := range entries {
+			res, err := tree.Find(getPaddedKey("4", i))
+			assert.Nil(t, err)
+			assert.Equal(t, value, res)
+		}
+
+		for n, i := range rng.Perm(MULTIPLE_TEST_COUNT * 4) {
+			err = tree.Delete(getPaddedKey("4", i))
+			if !assert.Nil(t, err, "seed %d key %d", seed, i) {
+				return
+			}
+
+			if n%MULTIPLE_TEST_COUNT == 0 {
+				assertTreeIsValid(t, tree)
+			}
+		}
+
+		assert.EqualValues(t, 0, tree.Count())
+		tree.Close()
+	}
+}
+
+// Compressed leaves that barely fit must keep fitting when only their pointers
+// to other nodes change, and when entries are removed from them.
+func TestCompressionWithRandomInsertsAndDeletes(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		tree, err := getTreeWithOptions(Options{PageSize: m_MIN_PAGE_SIZE, Compressor: DeflateCompressor{}})
+		assert.Nil(t, err)
+
+		rng := mathRand.New(mathRand.NewSource(seed))
+		randomBytes := func(maxLength int) []byte {
+			b := make([]byte, 1+rng.Intn(maxLength))
+			for i := range b {
+				b[i] = "abcdefgh"[rng.Intn(8)]
+			}
+
+			return b
+		}
+
+		entries := make(map[string][]byte)
+		keys := []string{}
+		for step := 0; step < MULTIPLE_TEST_COUNT*80; step++ {
+			if len(keys) > 0 && rng.Intn(4) == 0 {
+				idx := rng.Intn(len(keys))
+				err = tree.Delete([]byte(keys[idx]))
+				if !assert.Nil(t, err, "seed %d step %d", seed, step) {
+					return
+				}
+
+				delete(entries, keys[idx])
+				keys[idx] = keys[len(keys)-1]
+				keys = keys[:len(keys)-1]
+				continue
+			}
+
+			key := randomBytes(tree.maxKeySize())
+			if _, ok := entries[string(key)]; ok {
+				continue
+			}
+
+			value := bytes.Repeat(randomBytes(8), 1+rng.Intn(16))
+			err = tree.Insert(key, value)
+			if !assert.Nil(t, err, "seed %d step %d", seed, step) {
+				return
+			}
+
+			entries[string(key)] = value
+			keys = append(keys, string(key))
+		}
+
+		assertTreeIsValid(t, tree)
+		assert.EqualValues(t, len(entries), tree.Count())
+		for key, value := range entries {
+			res, err := tree.Find([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, res)
+		}
+
+		tree.Close()
+	}
 }
 
 func TestMultipleInsertAscendingKeys(t *testing.T) {
@@ -193,6 +591,30 @@ func TestInsertSameValueTwice(t *testing.T) {
 	assert.EqualValues(t, 2, rootNode.Numkeys)
 }
 
+func TestDeleteKeyWithSameValueAsOthers(t *testing.T) {
+	tree, err := getTree()
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	shared, other := []byte("v1"), []byte("v2")
+	for _, entry := range [][2][]byte{{[]byte("1"), shared}, {[]byte("2"), other}, {[]byte("3"), shared}} {
+		err = tree.Insert(entry[0], entry[1])
+		assert.Nil(t, err)
+	}
+
+	// The pointer of the deleted key goes, not the first one with the same value.
+	err = tree.Delete([]byte("3"))
+	assert.Nil(t, err)
+
+	res, err := tree.Find([]byte("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, shared, res)
+
+	res, err = tree.Find([]byte("2"))
+	assert.Nil(t, err)
+	assert.Equal(t, other, res)
+}
+
 func TestMultipleUpdateAscending(t *testing.T) {
 	tree, err := getTree()
 	assert.Nil(t, err)
@@ -380,6 +802,1504 @@ func TestDeleteRandom(t *testing.T) {
 	}
 }
 
+func TestReopen(t *testing.T) {
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+
+	tree, err := newTreeFromFile(f)
+	assert.Nil(t, err)
+
+	err = ascendingLoop(func(key, val []byte) error {
+		return tree.Insert(key, val)
+	})
+	assert.Nil(t, err)
+
+	tree, err = reopenTree(tree, memFS)
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	assert.EqualValues(t, MULTIPLE_TEST_COUNT, tree.Count())
+	err = ascendingLoop(func(key, val []byte) error {
+		res, err := tree.Find(key)
+		assert.Nil(t, err)
+		assert.Equal(t, val, res)
+
+		return nil
+	})
+	assert.Nil(t, err)
+
+	err = tree.Insert(getPaddedKey("2", MULTIPLE_TEST_COUNT), []byte("v"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, MULTIPLE_TEST_COUNT+1, tree.Count())
+}
+
+func TestReopenInvalidFile(t *testing.T) {
+	memFS := afero.NewMemMapFs()
+	err := afero.WriteFile(memFS, "memfile", make([]byte, m_DATA_OFFSET+m_DEFAULT_PAGE_SIZE), 0700)
+	assert.Nil(t, err)
+
+	f, err := memFS.OpenFile("memfile", os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	tree, err := newTreeFromFile(f)
+	assert.Nil(t, tree)
+	assert.Equal(t, INVALID_FILE_ERROR, err)
+}
+
+func TestReopenUnsupportedVersion(t *testing.T) {
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+
+	tree, err := newTreeFromFile(f)
+	assert.Nil(t, err)
+
+	err = tree.Insert([]byte("1"), []byte("v1"))
+	assert.Nil(t, err)
+
+	tree.masterPage.version = m_FORMAT_VERSION + 1
+	err = tree.writeMasterPage()
+	assert.Nil(t, err)
+	err = tree.commit()
+	assert.Nil(t, err)
+
+	tree, err = reopenTree(tree, memFS)
+	assert.Nil(t, tree)
+	assert.Equal(t, UNSUPPORTED_VERSION_ERROR, err)
+}
+
+func TestDeleteAllThenInsert(t *testing.T) {
+	tree, err := getTree()
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	err = tree.Insert([]byte("1"), []byte("v1"))
+	assert.Nil(t, err)
+
+	err = tree.Delete([]byte("1"))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, tree.Count())
+
+	err = tree.Insert([]byte("2"), []byte("v2"))
+	assert.Nil(t, err)
+
+	res, err := tree.Find([]byte("2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), res)
+}
+
+func TestInvalidOptions(t *testing.T) {
+	tree, err := getTreeWithOptions(Options{Order: 3})
+	assert.Nil(t, tree)
+	assert.Equal(t, INVALID_ORDER_ERROR, err)
+
+	tree, err = getTreeWithOptions(Options{PageSize: m_MIN_PAGE_SIZE - 1})
+	assert.Nil(t, tree)
+	assert.Equal(t, INVALID_PAGE_SIZE_ERROR, err)
+
+	tree, err = getTreeWithOptions(Options{PageSize: m_MAX_PAGE_SIZE + 1})
+	assert.Nil(t, tree)
+	assert.Equal(t, INVALID_PAGE_SIZE_ERROR, err)
+}
+
+func TestCustomOrderAndPageSize(t *testing.T) {
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+
+	tree, err := newTreeFromFileWithOptions(f, Options{Order: 7, PageSize: 1024})
+	assert.Nil(t, err)
+
+	err = descendingLoop(func(key, val []byte) error {
+		return tree.Insert(key, val)
+	})
+	assert.Nil(t, err)
+
+	rootNode, err := tree.readNode(tree.masterPage.root)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, rootNode.Numkeys, uint16(6))
+
+	stats, err := f.Stat()
+	assert.Nil(t, err)
+	assert.EqualValues(t, m_DATA_OFFSET+tree.masterPage.pageCount*1024, stats.Size())
+
+	tree, err = reopenTree(tree, memFS)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 7, tree.order)
+	assert.EqualValues(t, 1024, tree.pageSize)
+
+	err = descendingLoop(func(key, val []byte) error {
+		res, err := tree.Find(key)
+		assert.Nil(t, err)
+		assert.Equal(t, val, res)
+
+		return nil
+	})
+	assert.Nil(t, err)
+	tree.Close()
+
+	f, err = memFS.OpenFile("memfile", os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	tree, err = newTreeFromFileWithOptions(f, Options{PageSize: 2048})
+	assert.Nil(t, tree)
+	assert.Equal(t, INVALID_PAGE_SIZE_ERROR, err)
+}
+
+func TestAutomaticFanout(t *testing.T) {
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+
+	tree, err := newTreeFromFile(f)
+	assert.Nil(t, err)
+
+	count := 2000
+	keys := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		keys[i] = []byte(fmt.Sprintf("%016d", i))
+		err = tree.Insert(keys[i], []byte("v"+fmt.Sprint(i)))
+		assert.Nil(t, err)
+	}
+
+	// Nodes are filled by bytes.
+	assert.EqualValues(t, 0, tree.order)
+	root, err := tree.readNode(tree.masterPage.root)
+	assert.Nil(t, err)
+	assert.False(t, root.IsLeaf)
+	assert.Greater(t, int(root.Numkeys), 10)
+
+	leaf, err := tree.findLeaf(keys[0])
+	assert.Nil(t, err)
+	assert.Greater(t, int(leaf.Numkeys), 100)
+	assert.LessOrEqual(t, leaf.encodedSize(), tree.pageDataSize())
+	assert.Less(t, tree.masterPage.pageCount, uint64(count/100))
+
+	tree, err = reopenTree(tree, memFS)
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	assert.EqualValues(t, 0, tree.order)
+	for i := 0; i < count; i++ {
+		res, err := tree.Find(keys[i])
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v"+fmt.Sprint(i)), res)
+	}
+}
+
+func TestKeyTooLargeForPage(t *testing.T) {
+	tree, err := getTreeWithOptions(Options{PageSize: m_MIN_PAGE_SIZE})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	err = tree.Insert(make([]byte, 200), []byte("v"))
+	assert.Equal(t, KEY_SIZE_TOO_LARGE, err)
+}
+
+func TestDeleteKeepsRemainingKeys(t *testing.T) {
+	for _, opts := range []Options{{Order: 4}, {PageSize: m_MIN_PAGE_SIZE}, {PageSize: m_MIN_PAGE_SIZE, PrefixCompression: true}} {
+		tree, err := getTreeWithOptions(opts)
+		assert.Nil(t, err)
+
+		keys := make([][]byte, 0, MULTIPLE_TEST_COUNT*10)
+		for i := 0; i < MULTIPLE_TEST_COUNT*10; i++ {
+			key := getPaddedKey("4", i)
+			keys = append(keys, key)
+			err = tree.Insert(key, bytes.Repeat([]byte("v"), mathRand.Intn(60)))
+			assert.Nil(t, err)
+		}
+
+		assertTreeIsValid(t, tree)
+		mathRand.Shuffle(len(keys), func(i, j int) {
+			keys[i], keys[j] = keys[j], keys[i]
+		})
+
+		deleted := keys[:len(keys)*3/4]
+		for _, key := range deleted {
+			err = tree.Delete(key)
+			assert.Nil(t, err)
+		}
+
+		assertTreeIsValid(t, tree)
+		assert.EqualValues(t, len(keys)-len(deleted), tree.Count())
+		for _, key := range deleted {
+			_, err := tree.Find(key)
+			assert.Equal(t, KEY_NOT_FOUND_ERROR, err)
+		}
+
+		for _, key := range keys[len(deleted):] {
+			_, err := tree.Find(key)
+			assert.Nil(t, err)
+		}
+
+		for _, key := range keys[len(deleted):] {
+			err = tree.Delete(key)
+			assert.Nil(t, err)
+		}
+
+		assert.Nil(t, tree.masterPage)
+		tree.Close()
+	}
+}
+
+func TestInsertVariableValueSizes(t *testing.T) {
+	tree, err := getTreeWithOptions(Options{PageSize: m_MIN_PAGE_SIZE})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	maxValueSize := tree.maxInlineEntrySize() - 2 - 4
+	values := make(map[string][]byte)
+	for i := 0; i < MULTIPLE_TEST_COUNT*4; i++ {
+		key := getPaddedKey("4", mathRand.Intn(10000))
+		if _, ok := values[string(key)]; ok {
+			continue
+		}
+
+		value := bytes.Repeat([]byte{byte(i)}, mathRand.Intn(maxValueSize+1))
+		values[string(key)] = value
+		err = tree.Insert(key, value)
+		assert.Nil(t, err)
+	}
+
+	assertTreeIsValid(t, tree)
+	for key, value := range values {
+		res, err := tree.Find([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, res)
+	}
+}
+
+func TestUpdateSplitsLeaf(t *testing.T) {
+	tree, err := getTreeWithOptions(Options{PageSize: m_MIN_PAGE_SIZE})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	err = ascendingLoop(func(key, val []byte) error {
+		return tree.Insert(key, val)
+	})
+	assert.Nil(t, err)
+
+	pageCount := tree.masterPage.pageCount
+	newVal := bytes.Repeat([]byte("n"), tree.maxInlineEntrySize()-2-4)
+	err = ascendingLoop(func(key, val []byte) error {
+		return tree.Update(key, newVal)
+	})
+	assert.Nil(t, err)
+	assert.Greater(t, tree.masterPage.pageCount, pageCount)
+
+	assertTreeIsValid(t, tree)
+	err = ascendingLoop(func(key, val []byte) error {
+		res, err := tree.Find(key)
+		assert.Nil(t, err)
+		assert.Equal(t, newVal, res)
+
+		return nil
+	})
+	assert.Nil(t, err)
+}
+
+func TestOverflowValues(t *testing.T) {
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+	tree, err := newTreeFromFileWithOptions(f, Options{PageSize: m_MIN_PAGE_SIZE})
+	assert.Nil(t, err)
+
+	values := make(map[string][]byte)
+	for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+		key := getPaddedKey("4", i)
+		value := make([]byte, mathRand.Intn(m_MIN_PAGE_SIZE*8))
+		_, err = rand.Read(value)
+		assert.Nil(t, err)
+		values[string(key)] = value
+
+		err = tree.Insert(key, value)
+		assert.Nil(t, err)
+	}
+
+	tree, err = reopenTree(tree, memFS)
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	assertTreeIsValid(t, tree)
+	for key, value := range values {
+		res, err := tree.Find([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, res)
+	}
+
+	// Values can move between overflow pages and the leaf when updated.
+	for key, value := range values {
+		newValue := value[:len(value)/8]
+		err = tree.Update([]byte(key), newValue)
+		assert.Nil(t, err)
+		values[key] = newValue
+	}
+
+	assertTreeIsValid(t, tree)
+	for key, value := range values {
+		res, err := tree.Find([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, res)
+	}
+}
+
+func TestFreedPagesAreReused(t *testing.T) {
+	tree, err := getTreeWithOptions(Options{Order: 4})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	// Keep one key so that the tree is never emptied and truncated.
+	err = tree.Insert(getPaddedKey("4", 0), []byte("v"))
+	assert.Nil(t, err)
+
+	pageCount := uint64(0)
+	for round := 0; round < 5; round++ {
+		for i := 1; i < MULTIPLE_TEST_COUNT; i++ {
+			err = tree.Insert(getPaddedKey("4", i), []byte("v"))
+			assert.Nil(t, err)
+		}
+
+		if round == 0 {
+			pageCount = tree.masterPage.pageCount
+		}
+
+		assert.Equal(t, pageCount, tree.masterPage.pageCount)
+		assertTreeIsValid(t, tree)
+
+		for _, i := range mathRand.Perm(MULTIPLE_TEST_COUNT - 1) {
+			err = tree.Delete(getPaddedKey("4", i+1))
+			assert.Nil(t, err)
+		}
+
+		assertTreeIsValid(t, tree)
+		assert.Equal(t, pageCount-1, tree.masterPage.freePageCount)
+	}
+}
+
+func TestOverflowPagesAreReused(t *testing.T) {
+	tree, err := getTreeWithOptions(Options{PageSize: m_MIN_PAGE_SIZE})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	err = tree.Insert([]byte("1"), []byte("v1"))
+	assert.Nil(t, err)
+
+	largeValue := bytes.Repeat([]byte("l"), m_MIN_PAGE_SIZE*4)
+	err = tree.Insert([]byte("2"), largeValue)
+	assert.Nil(t, err)
+
+	pageCount := tree.masterPage.pageCount
+	for i := 0; i < 10; i++ {
+		err = tree.Delete([]byte("2"))
+		assert.Nil(t, err)
+		assert.NotZero(t, tree.masterPage.freePageCount)
+
+		err = tree.Insert([]byte("2"), largeValue)
+		assert.Nil(t, err)
+
+		err = tree.Update([]byte("1"), largeValue)
+		assert.Nil(t, err)
+
+		err = tree.Update([]byte("1"), []byte("v1"))
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, pageCount+tree.masterPage.freePageCount, tree.masterPage.pageCount)
+
+	res, err := tree.Find([]byte("2"))
+	assert.Nil(t, err)
+	assert.Equal(t, largeValue, res)
+}
+
+func TestEncryption(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.Nil(t, err)
+
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+	tree, err := newTreeFromFileWithOptions(f, Options{PageSize: m_MIN_PAGE_SIZE, EncryptionKey: key})
+	assert.Nil(t, err)
+
+	secret := bytes.Repeat([]byte("secret"), m_MIN_PAGE_SIZE)
+	err = ascendingLoop(func(key, val []byte) error {
+		return tree.Insert(key, append(val, secret[:mathRand.Intn(len(secret))]...))
+	})
+	assert.Nil(t, err)
+
+	// Neither keys nor values should be readable from the file.
+	fileBytes, err := afero.ReadFile(memFS, "memfile")
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(fileBytes, []byte("secret")))
+	assert.False(t, bytes.Contains(fileBytes, getPaddedKey("4", 1)))
+
+	tree, err = reopenTreeWithOptions(tree, memFS, Options{EncryptionKey: key})
+	assert.Nil(t, err)
+	assertTreeIsValid(t, tree)
+	err = ascendingLoop(func(key, val []byte) error {
+		res, err := tree.Find(key)
+		assert.Nil(t, err)
+		assert.Equal(t, val, res[:len(val)])
+
+		return nil
+	})
+	assert.Nil(t, err)
+
+	wrongKey := make([]byte, 32)
+	_, err = reopenTreeWithOptions(tree, memFS, Options{EncryptionKey: wrongKey})
+	assert.Equal(t, DECRYPTION_ERROR, err)
+
+	_, err = reopenTree(tree, memFS)
+	assert.Equal(t, INVALID_FILE_ERROR, err)
+
+	_, err = reopenTreeWithOptions(tree, memFS, Options{EncryptionKey: key[:16]})
+	assert.Equal(t, INVALID_ENCRYPTION_KEY_ERROR, err)
+}
+
+func TestEncryptionDetectsTampering(t *testing.T) {
+	key := make([]byte, 32)
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+	tree, err := newTreeFromFileWithOptions(f, Options{EncryptionKey: key})
+	assert.Nil(t, err)
+
+	err = tree.Insert([]byte("1"), []byte("v1"))
+	assert.Nil(t, err)
+	tree.Close()
+
+	fileBytes, err := afero.ReadFile(memFS, "memfile")
+	assert.Nil(t, err)
+	fileBytes[m_DATA_OFFSET+m_GCM_IV_SIZE] ^= 1
+	err = afero.WriteFile(memFS, "memfile", fileBytes, 0700)
+	assert.Nil(t, err)
+
+	f, err = memFS.OpenFile("memfile", os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	tree, err = newTreeFromFileWithOptions(f, Options{EncryptionKey: key})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	_, err = tree.Find([]byte("1"))
+	assert.Equal(t, DECRYPTION_ERROR, err)
+}
+
+func TestChecksumDetectsCorruption(t *testing.T) {
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+	tree, err := newTreeFromFileWithOptions(f, Options{PageSize: m_MIN_PAGE_SIZE})
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("v"), 64)
+	for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+		err = tree.Insert(getPaddedKey("4", i), value)
+		assert.Nil(t, err)
+	}
+
+	firstKey, lastKey := getPaddedKey("4", 0), getPaddedKey("4", MULTIPLE_TEST_COUNT-1)
+
+	leaf, err := tree.findLeaf(firstKey)
+	assert.Nil(t, err)
+	tree.Close()
+
+	corrupt := func(offset uint64) {
+		fileBytes, err := afero.ReadFile(memFS, "memfile")
+		assert.Nil(t, err)
+		fileBytes[offset] ^= 1
+		err = afero.WriteFile(memFS, "memfile", fileBytes, 0700)
+		assert.Nil(t, err)
+	}
+
+	corrupt(leaf.Ptr + m_NODE_HEADER_SIZE)
+	f, err = memFS.OpenFile("memfile", os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	tree, err = newTreeFromFile(f)
+	assert.Nil(t, err)
+
+	_, err = tree.Find(firstKey)
+	var corruptErr *ErrCorruptPage
+	assert.True(t, errors.As(err, &corruptErr))
+	assert.Equal(t, leaf.Ptr, corruptErr.Ptr)
+
+	// Other leaves can still be read.
+	res, err := tree.Find(lastKey)
+	assert.Nil(t, err)
+	assert.Equal(t, value, res)
+	tree.Close()
+
+	// The tree can't be opened if both master page slots are corrupted.
+	corrupt(40)
+	corrupt(m_MASTER_PAGE_SIZE + 40)
+	f, err = memFS.OpenFile("memfile", os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	tree, err = newTreeFromFile(f)
+	assert.Nil(t, tree)
+	assert.True(t, errors.As(err, &corruptErr))
+	assert.EqualValues(t, 0, corruptErr.Ptr)
+}
+
+// A file that fails every write once `writesLeft` reaches 0, like a crash would,
+// or only that one write if `failOnce` is set.
+type crashingFile struct {
+	afero.File
+	writesLeft int
+	failOnce   bool
+}
+
+func (f *crashingFile) WriteAt(b []byte, offset int64) (int, error) {
+	if f.writesLeft == 0 {
+		if f.failOnce {
+			f.writesLeft = -1
+		}
+		return 0, errors.New("crashed")
+	}
+
+	f.writesLeft--
+	return f.File.WriteAt(b, offset)
+}
+
+type syncCountingFile struct {
+	afero.File
+	syncs int
+}
+
+func (f *syncCountingFile) Sync() error {
+	f.syncs++
+	return f.File.Sync()
+}
+
+// Fills a tree and then crashes while inserting one more key after `writesLeft`
+// writes to the db file. It returns the file system, the key of the last insert
+// and the error of the last insert, which is nil if it didn't crash.
+func crashDuringInsert(t *testing.T, opts Options, writesLeft int) (afero.Fs, []byte, error) {
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+	walFile, err := memFS.Create("memfile-wal")
+	assert.Nil(t, err)
+
+	dbFile := &crashingFile{File: f, writesLeft: -1}
+	tree, err := newTreeFromFiles(dbFile, walFile, opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+		err = tree.Insert(getPaddedKey("4", i), []byte("v"))
+		assert.Nil(t, err)
+	}
+
+	// Every split in the path causes more pages to be written.
+	dbFile.writesLeft = writesLeft
+	key := getPaddedKey("4", MULTIPLE_TEST_COUNT)
+	err = tree.Insert(key, []byte("v"))
+
+	return memFS, key, err
+}
+
+func TestWALReplaysInterruptedWrite(t *testing.T) {
+	memFS, key, err := crashDuringInsert(t, Options{Order: 4}, 1)
+	assert.NotNil(t, err)
+
+	f, err := memFS.OpenFile("memfile", os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	walFile, err := memFS.OpenFile("memfile-wal", os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	tree, err := newTreeFromFiles(f, walFile, Options{})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	assertTreeIsValid(t, tree)
+	assert.EqualValues(t, MULTIPLE_TEST_COUNT+1, tree.Count())
+	res, err := tree.Find(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), res)
+
+	stats, err := walFile.Stat()
+	assert.Nil(t, err)
+	assert.Zero(t, stats.Size())
+}
+
+func TestWALDiscardsIncompleteRecord(t *testing.T) {
+	memFS, key, err := crashDuringInsert(t, Options{Order: 4}, 0)
+	assert.NotNil(t, err)
+
+	// Cut the record short as if we crashed while writing it.
+	record, err := afero.ReadFile(memFS, "memfile-wal")
+	assert.Nil(t, err)
+	assert.NotZero(t, len(record))
+	err = afero.WriteFile(memFS, "memfile-wal", record[:len(record)/2], 0700)
+	assert.Nil(t, err)
+
+	f, err := memFS.OpenFile("memfile", os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	walFile, err := memFS.OpenFile("memfile-wal", os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	tree, err := newTreeFromFiles(f, walFile, Options{})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	assertTreeIsValid(t, tree)
+	assert.EqualValues(t, MULTIPLE_TEST_COUNT, tree.Count())
+	_, err = tree.Find(key)
+	assert.Equal(t, KEY_NOT_FOUND_ERROR, err)
+}
+
+func TestWritesAfterFailedCommit(t *testing.T) {
+	// If the write fails only once the log is replayed right away, otherwise
+	// it's replayed before the next write.
+	for _, failOnce := range []bool{true, false} {
+		for writesLeft := 0; writesLeft < 4; writesLeft++ {
+			memFS := afero.NewMemMapFs()
+			f, err := memFS.Create("memfile")
+			assert.Nil(t, err)
+			walFile, err := memFS.Create("memfile-wal")
+			assert.Nil(t, err)
+
+			dbFile := &crashingFile{File: f, writesLeft: -1, failOnce: failOnce}
+			tree, err := newTreeFromFiles(dbFile, walFile, Options{Order: 4})
+			assert.Nil(t, err)
+
+			// The fourth key splits the root.
+			for i := 0; i < 3; i++ {
+				err = tree.Insert(getPaddedKey("4", i), []byte("v"))
+				assert.Nil(t, err)
+			}
+
+			dbFile.writesLeft = writesLeft
+			err = tree.Insert(getPaddedKey("4", 3), []byte("v"))
+			assert.NotNil(t, err)
+			dbFile.writesLeft = -1
+
+			for i := 4; i < MULTIPLE_TEST_COUNT; i++ {
+				err = tree.Insert(getPaddedKey("4", i), []byte("v"))
+				assert.Nil(t, err)
+			}
+
+			tree, err = reopenTree(tree, memFS)
+			assert.Nil(t, err)
+			assertTreeIsValid(t, tree)
+			assert.EqualValues(t, MULTIPLE_TEST_COUNT, tree.Count())
+			for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+				res, err := tree.Find(getPaddedKey("4", i))
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("v"), res)
+			}
+
+			assert.Nil(t, tree.Close())
+		}
+	}
+}
+
+func TestWALIgnoresLeftoverBytes(t *testing.T) {
+	memFS, key, err := crashDuringInsert(t, Options{Order: 4}, 1)
+	assert.NotNil(t, err)
+
+	// Leave the tail of a longer record behind the one that has to be replayed.
+	record, err := afero.ReadFile(memFS, "memfile-wal")
+	assert.Nil(t, err)
+	record = append(record, bytes.Repeat([]byte{0xff}, 100)...)
+	err = afero.WriteFile(memFS, "memfile-wal", record, 0700)
+	assert.Nil(t, err)
+
+	f, err := memFS.OpenFile("memfile", os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	walFile, err := memFS.OpenFile("memfile-wal", os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	tree, err := newTreeFromFiles(f, walFile, Options{})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	assertTreeIsValid(t, tree)
+	assert.EqualValues(t, MULTIPLE_TEST_COUNT+1, tree.Count())
+	res, err := tree.Find(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), res)
+}
+
+func TestCopyOnWrite(t *testing.T) {
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+	opts := Options{PageSize: m_MIN_PAGE_SIZE, CopyOnWrite: true}
+	tree, err := newTreeFromFileWithOptions(f, opts)
+	assert.Nil(t, err)
+
+	values := make(map[string][]byte)
+	for i := 0; i < MULTIPLE_TEST_COUNT*4; i++ {
+		key := getPaddedKey("4", mathRand.Intn(MULTIPLE_TEST_COUNT*2))
+		value := bytes.Repeat([]byte{byte(i)}, mathRand.Intn(m_MIN_PAGE_SIZE))
+		if _, ok := values[string(key)]; ok {
+			if i%2 == 0 {
+				err = tree.Delete(key)
+				delete(values, string(key))
+			} else {
+				err = tree.Update(key, value)
+				values[string(key)] = value
+			}
+		} else {
+			err = tree.Insert(key, value)
+			values[string(key)] = value
+		}
+
+		assert.Nil(t, err)
+	}
+
+	_, err = reopenTree(tree, memFS)
+	assert.Equal(t, COPY_ON_WRITE_MISMATCH_ERROR, err)
+
+	tree, err = reopenTreeWithOptions(tree, memFS, opts)
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	assertTreeIsValid(t, tree)
+	assert.EqualValues(t, len(values), tree.Count())
+	for key, value := range values {
+		res, err := tree.Find([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, res)
+	}
+}
+
+func TestCopyOnWriteKeepsPreviousVersionOnCrash(t *testing.T) {
+	for writesLeft := 0; ; writesLeft++ {
+		memFS, key, insertErr := crashDuringInsert(t, Options{Order: 4, CopyOnWrite: true}, writesLeft)
+
+		f, err := memFS.OpenFile("memfile", os.O_RDWR, 0700)
+		assert.Nil(t, err)
+		tree, err := newTreeFromFileWithOptions(f, Options{CopyOnWrite: true})
+		assert.Nil(t, err)
+
+		// The tree is either as it was before the insert or as it is after it.
+		assertTreeIsValid(t, tree)
+		_, err = tree.Find(key)
+		if insertErr != nil {
+			assert.EqualValues(t, MULTIPLE_TEST_COUNT, tree.Count())
+			assert.Equal(t, KEY_NOT_FOUND_ERROR, err)
+		} else {
+			assert.EqualValues(t, MULTIPLE_TEST_COUNT+1, tree.Count())
+			assert.Nil(t, err)
+		}
+
+		tree.Close()
+		if insertErr == nil {
+			break
+		}
+	}
+}
+
+func TestCopyOnWriteReusesPages(t *testing.T) {
+	tree, err := getTreeWithOptions(Options{Order: 4, CopyOnWrite: true})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+		err = tree.Insert(getPaddedKey("4", i), []byte("v"))
+		assert.Nil(t, err)
+	}
+
+	physicalPageCount := tree.masterPage.physicalPageCount
+	for i := 0; i < MULTIPLE_TEST_COUNT*4; i++ {
+		err = tree.Update(getPaddedKey("4", i%MULTIPLE_TEST_COUNT), []byte(fmt.Sprint(i)))
+		assert.Nil(t, err)
+	}
+
+	// Every update needs a new leaf, table page and directory page, and the
+	// old ones are reused by the next update.
+	assert.LessOrEqual(t, tree.masterPage.physicalPageCount, physicalPageCount+3)
+	assertTreeIsValid(t, tree)
+}
+
+func TestMasterPageFallsBackToOtherSlot(t *testing.T) {
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+	opts := Options{Order: 4, CopyOnWrite: true}
+	tree, err := newTreeFromFileWithOptions(f, opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+		err = tree.Insert(getPaddedKey("4", i), []byte("v"))
+		assert.Nil(t, err)
+	}
+
+	// Tear the newest master page as if we crashed while writing it.
+	slot := (tree.masterPage.sequence % m_MASTER_PAGE_SLOTS) * m_MASTER_PAGE_SIZE
+	tree.Close()
+	fileBytes, err := afero.ReadFile(memFS, "memfile")
+	assert.Nil(t, err)
+	copy(fileBytes[slot+m_MASTER_PAGE_SIZE/2:slot+m_MASTER_PAGE_SIZE], make([]byte, m_MASTER_PAGE_SIZE/2))
+	err = afero.WriteFile(memFS, "memfile", fileBytes, 0700)
+	assert.Nil(t, err)
+
+	f, err = memFS.OpenFile("memfile", os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	tree, err = newTreeFromFileWithOptions(f, opts)
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	// The tree is back to how it was before the last insert.
+	assertTreeIsValid(t, tree)
+	assert.EqualValues(t, MULTIPLE_TEST_COUNT-1, tree.Count())
+	_, err = tree.Find(getPaddedKey("4", MULTIPLE_TEST_COUNT-1))
+	assert.Equal(t, KEY_NOT_FOUND_ERROR, err)
+
+	// Writing goes on from the intact slot.
+	err = tree.Insert(getPaddedKey("4", MULTIPLE_TEST_COUNT-1), []byte("v"))
+	assert.Nil(t, err)
+	assertTreeIsValid(t, tree)
+}
+
+func TestBufferPool(t *testing.T) {
+	tree, err := getTreeWithOptions(Options{Order: 4, BufferPoolSize: 8})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	_, err = getTreeWithOptions(Options{BufferPoolSize: -1})
+	assert.Equal(t, INVALID_BUFFER_POOL_SIZE_ERROR, err)
+
+	for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+		err = tree.Insert(getPaddedKey("4", i), []byte("v"))
+		assert.Nil(t, err)
+	}
+
+	assert.LessOrEqual(t, tree.bufferPool.lru.Len(), 8)
+
+	// The path to the same key stays in the pool.
+	key := getPaddedKey("4", 0)
+	_, err = tree.Find(key)
+	assert.Nil(t, err)
+	stats := tree.BufferPoolStats()
+	for i := 0; i < 10; i++ {
+		res, err := tree.Find(key)
+		assert.Nil(t, err)
+
+		// Changing the returned value doesn't change the tree.
+		res[0] = 'x'
+	}
+
+	newStats := tree.BufferPoolStats()
+	assert.Equal(t, stats.Misses, newStats.Misses)
+	assert.Greater(t, newStats.Hits, stats.Hits)
+
+	res, err := tree.Find(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), res)
+}
+
+func TestBufferPoolEvictsLeastRecentlyUsed(t *testing.T) {
+	pool := newBufferPool(2)
+	for ptr := uint64(1); ptr <= 3; ptr++ {
+		pool.put(ptr, &DiskBTreeNode{Ptr: ptr})
+	}
+
+	assert.Equal(t, 2, pool.lru.Len())
+	_, ok := pool.get(1)
+	assert.False(t, ok)
+
+	node, ok := pool.get(2)
+	assert.True(t, ok)
+	assert.EqualValues(t, 2, node.Ptr)
+
+	// 3 is the least recently used now.
+	pool.put(4, &DiskBTreeNode{Ptr: 4})
+	_, ok = pool.get(3)
+	assert.False(t, ok)
+	assert.Equal(t, BufferPoolStats{Hits: 1, Misses: 2}, BufferPoolStats{Hits: pool.hits, Misses: pool.misses})
+}
+
+func TestConcurrentFind(t *testing.T) {
+	// Files of afero's memory file system can't be read concurrently.
+	path := filepath.Join(t.TempDir(), "tree")
+	f, err := os.Create(path)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	tree, err := NewTreeWithOptions(path, Options{Order: 4, BufferPoolSize: 4})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+		err = tree.Insert(getPaddedKey("4", i), []byte("v"+fmt.Sprint(i)))
+		assert.Nil(t, err)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+				key := (i + g) % MULTIPLE_TEST_COUNT
+				res, err := tree.Find(getPaddedKey("4", key))
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("v"+fmt.Sprint(key)), res)
+			}
+		}(g)
+	}
+
+	// Writes wait for the reads and the other way around.
+	for i := MULTIPLE_TEST_COUNT; i < MULTIPLE_TEST_COUNT*2; i++ {
+		err = tree.Insert(getPaddedKey("4", i), []byte("v"+fmt.Sprint(i)))
+		assert.Nil(t, err)
+	}
+
+	wg.Wait()
+	assertTreeIsValid(t, tree)
+}
+
+func TestWriteBack(t *testing.T) {
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+	walFile, err := memFS.Create("memfile-wal")
+	assert.Nil(t, err)
+	tree, err := newTreeFromFiles(f, walFile, Options{Order: 4, WriteBack: true})
+	assert.Nil(t, err)
+
+	for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+		err = tree.Insert(getPaddedKey("4", i), []byte("v"+fmt.Sprint(i)))
+		assert.Nil(t, err)
+	}
+
+	// Nothing is written until the tree is flushed.
+	stats, err := f.Stat()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, stats.Size())
+
+	// A failed operation doesn't undo the ones before it.
+	err = tree.Insert(getPaddedKey("4", 0), []byte("v"))
+	assert.Equal(t, KEY_ALREADY_EXISTS_ERROR, err)
+	err = tree.Delete(getPaddedKey("4", MULTIPLE_TEST_COUNT))
+	assert.Equal(t, KEY_NOT_FOUND_ERROR, err)
+	assertTreeIsValid(t, tree)
+	assert.EqualValues(t, MULTIPLE_TEST_COUNT, tree.Count())
+
+	err = tree.Sync()
+	assert.Nil(t, err)
+	stats, err = f.Stat()
+	assert.Nil(t, err)
+	assert.NotEqualValues(t, 0, stats.Size())
+
+	for i := 0; i < MULTIPLE_TEST_COUNT; i += 2 {
+		err = tree.Delete(getPaddedKey("4", i))
+		assert.Nil(t, err)
+	}
+
+	// Closing the tree flushes it.
+	tree, err = reopenTree(tree, memFS)
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	assertTreeIsValid(t, tree)
+	assert.EqualValues(t, MULTIPLE_TEST_COUNT/2, tree.Count())
+	for i := 1; i < MULTIPLE_TEST_COUNT; i += 2 {
+		res, err := tree.Find(getPaddedKey("4", i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v"+fmt.Sprint(i)), res)
+	}
+}
+
+func TestDurability(t *testing.T) {
+	_, err := getTreeWithOptions(Options{Durability: SYNC_PERIODIC + 1})
+	assert.Equal(t, INVALID_DURABILITY_ERROR, err)
+	_, err = getTreeWithOptions(Options{Durability: SYNC_PERIODIC, SyncInterval: -1})
+	assert.Equal(t, INVALID_SYNC_INTERVAL_ERROR, err)
+
+	getTreeWithSyncCount := func(opts Options) (*DiskBTree, *syncCountingFile, *syncCountingFile) {
+		memFS := afero.NewMemMapFs()
+		f, err := memFS.Create("memfile")
+		assert.Nil(t, err)
+		walFile, err := memFS.Create("memfile-wal")
+		assert.Nil(t, err)
+
+		dbFile, countingWALFile := &syncCountingFile{File: f}, &syncCountingFile{File: walFile}
+		tree, err := newTreeFromFiles(dbFile, countingWALFile, opts)
+		assert.Nil(t, err)
+
+		for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+			err = tree.Insert(getPaddedKey("4", i), []byte("v"))
+			assert.Nil(t, err)
+		}
+
+		return tree, dbFile, countingWALFile
+	}
+
+	// The log and the file are synced on every insert.
+	tree, dbFile, walFile := getTreeWithSyncCount(Options{Order: 4})
+	assert.Equal(t, MULTIPLE_TEST_COUNT, dbFile.syncs)
+	assert.Equal(t, MULTIPLE_TEST_COUNT, walFile.syncs)
+	assert.Nil(t, tree.Close())
+
+	tree, dbFile, walFile = getTreeWithSyncCount(Options{Order: 4, Durability: SYNC_NONE})
+	assert.Equal(t, 0, dbFile.syncs)
+	assert.Equal(t, 0, walFile.syncs)
+	assert.Equal(t, MULTIPLE_TEST_COUNT, int(tree.Count()))
+
+	// Sync always syncs.
+	assert.Nil(t, tree.Sync())
+	assert.Equal(t, 1, dbFile.syncs)
+	assert.Nil(t, tree.Close())
+
+	// Nothing is written within the interval.
+	tree, dbFile, walFile = getTreeWithSyncCount(Options{Order: 4, Durability: SYNC_PERIODIC, SyncInterval: time.Hour})
+	assert.Equal(t, 0, dbFile.syncs)
+	assert.Equal(t, 0, walFile.syncs)
+	stats, err := dbFile.Stat()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, stats.Size())
+
+	// All of the inserts are written with a single sync of each file.
+	assert.Nil(t, tree.Flush())
+	assert.Equal(t, 1, dbFile.syncs)
+	assert.Equal(t, 1, walFile.syncs)
+	assertTreeIsValid(t, tree)
+	assert.Nil(t, tree.Close())
+
+	// Every insert after the interval has passed is written.
+	tree, dbFile, _ = getTreeWithSyncCount(Options{Order: 4, Durability: SYNC_PERIODIC, SyncInterval: time.Nanosecond})
+	assert.Equal(t, MULTIPLE_TEST_COUNT, dbFile.syncs)
+	assert.Nil(t, tree.Close())
+
+	// The inserts are flushed in the background even if no write comes after them.
+	tree, dbFile, walFile = getTreeWithSyncCount(Options{Order: 4, Durability: SYNC_PERIODIC, SyncInterval: 10 * time.Millisecond})
+	assert.Eventually(t, func() bool {
+		tree.mu.RLock()
+		defer tree.mu.RUnlock()
+
+		return len(tree.pendingPages) == 0 && dbFile.syncs > 0 && walFile.syncs > 0
+	}, time.Second, time.Millisecond)
+	assertTreeIsValid(t, tree)
+
+	// Closing the tree twice at the same time doesn't stop syncing twice. Holding
+	// the lock keeps the first Close waiting for the flush in the background.
+	tree.mu.Lock()
+	time.Sleep(20 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tree.Close()
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	tree.mu.Unlock()
+	wg.Wait()
+
+	// The file is synced without a log too.
+	f, err := afero.NewMemMapFs().Create("memfile")
+	assert.Nil(t, err)
+	dbFile = &syncCountingFile{File: f}
+	tree, err = newTreeFromFileWithOptions(dbFile, Options{Order: 4})
+	assert.Nil(t, err)
+	for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+		err = tree.Insert(getPaddedKey("4", i), []byte("v"))
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, MULTIPLE_TEST_COUNT, dbFile.syncs)
+	assert.Nil(t, tree.Close())
+}
+
+func TestWriteBackFlushesAtThreshold(t *testing.T) {
+	_, err := getTreeWithOptions(Options{WriteBack: true, FlushThreshold: -1})
+	assert.Equal(t, INVALID_FLUSH_THRESHOLD_ERROR, err)
+
+	tree, err := getTreeWithOptions(Options{Order: 4, WriteBack: true, FlushThreshold: 8})
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+		err = tree.Insert(getPaddedKey("4", i), []byte("v"))
+		assert.Nil(t, err)
+		assert.Less(t, len(tree.pendingPages), 8)
+	}
+
+	stats, err := tree.dbFile.Stat()
+	assert.Nil(t, err)
+	assert.NotEqualValues(t, 0, stats.Size())
+}
+
+func TestCursor(t *testing.T) {
+	tree, err := getTree()
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	cursor := tree.Cursor()
+	assert.False(t, cursor.First())
+	assert.False(t, cursor.Last())
+	assert.False(t, cursor.Next())
+	assert.Nil(t, cursor.Err())
+
+	// Only even keys are inserted, so that odd keys can be seeked to between them.
+	count := MULTIPLE_TEST_COUNT * 4
+	for _, i := range mathRand.Perm(count) {
+		err = tree.Insert(getPaddedKey("4", 2*i), []byte(fmt.Sprint(i)))
+		assert.Nil(t, err)
+	}
+
+	i := 0
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		assert.Equal(t, getPaddedKey("4", 2*i), cursor.Key())
+		assert.Equal(t, []byte(fmt.Sprint(i)), cursor.Value())
+		i++
+	}
+
+	assert.Equal(t, count, i)
+	assert.False(t, cursor.Valid())
+	assert.Nil(t, cursor.Err())
+
+	for ok := cursor.Last(); ok; ok = cursor.Prev() {
+		i--
+		assert.Equal(t, getPaddedKey("4", 2*i), cursor.Key())
+	}
+
+	assert.Equal(t, 0, i)
+
+	assert.True(t, cursor.Seek(getPaddedKey("4", 10)))
+	assert.Equal(t, getPaddedKey("4", 10), cursor.Key())
+	assert.True(t, cursor.Seek(getPaddedKey("4", 11)))
+	assert.Equal(t, getPaddedKey("4", 12), cursor.Key())
+	assert.True(t, cursor.Prev())
+	assert.Equal(t, getPaddedKey("4", 10), cursor.Key())
+	assert.False(t, cursor.Seek(getPaddedKey("4", 2*count)))
+
+	// Deleting the entries while walking them doesn't skip any of them.
+	i = 0
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		assert.Equal(t, getPaddedKey("4", 2*i), cursor.Key())
+		err = tree.Delete(cursor.Key())
+		assert.Nil(t, err)
+		i++
+	}
+
+	assert.Equal(t, count, i)
+	assert.EqualValues(t, 0, tree.Count())
+}
+
+func TestRange(t *testing.T) {
+	tree, err := getTree()
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	count := MULTIPLE_TEST_COUNT * 4
+	for _, i := range mathRand.Perm(count) {
+		err = tree.Insert(getPaddedKey("4", i), []byte(fmt.Sprint(i)))
+		assert.Nil(t, err)
+	}
+
+	key := func(i int) []byte {
+		return getPaddedKey("4", i)
+	}
+
+	tests := []struct {
+		start, end  []byte
+		opts        RangeOptions
+		first, last int
+	}{
+		{nil, nil, RangeOptions{}, 0, count - 1},
+		{key(10), key(20), RangeOptions{}, 10, 19},
+		{key(10), key(20), RangeOptions{IncludeEnd: true}, 10, 20},
+		{key(10), key(20), RangeOptions{ExcludeStart: true}, 11, 19},
+		{nil, key(20), RangeOptions{}, 0, 19},
+		{key(10), nil, RangeOptions{}, 10, count - 1},
+		{[]byte("0010.5"), []byte("0019.5"), RangeOptions{}, 11, 19},
+		{key(count - 5), key(count + 5), RangeOptions{}, count - 5, count - 1},
+	}
+
+	for _, test := range tests {
+		i := test.first
+		err = tree.RangeWithOptions(test.start, test.end, test.opts, func(k, v []byte) bool {
+			assert.Equal(t, key(i), k)
+			assert.Equal(t, []byte(fmt.Sprint(i)), v)
+			i++
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, test.last+1, i)
+
+		err = tree.ReverseRangeWithOptions(test.start, test.end, test.opts, func(k, v []byte) bool {
+			i--
+			assert.Equal(t, key(i), k)
+			assert.Equal(t, []byte(fmt.Sprint(i)), v)
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, test.first, i)
+	}
+
+	// Scans stop once fn returns false.
+	keys := [][]byte{}
+	err = tree.RangeFunc(key(10), nil, func(k, v []byte) bool {
+		keys = append(keys, k)
+		return len(keys) < 3
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{key(10), key(11), key(12)}, keys)
+
+	keys = [][]byte{}
+	err = tree.ReverseRange(nil, key(10), func(k, v []byte) bool {
+		keys = append(keys, k)
+		return len(keys) < 3
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{key(9), key(8), key(7)}, keys)
+
+	err = tree.RangeFunc(key(20), key(10), func(k, v []byte) bool {
+		t.Fatalf("unexpected key %s", k)
+		return true
+	})
+	assert.Nil(t, err)
+
+	err = tree.ReverseRange(key(20), key(10), func(k, v []byte) bool {
+		t.Fatalf("unexpected key %s", k)
+		return true
+	})
+	assert.Nil(t, err)
+}
+
+func TestScanPrefix(t *testing.T) {
+	tree, err := getTree()
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	tenants := []string{"a", "b", "bb", "c"}
+	for _, i := range mathRand.Perm(MULTIPLE_TEST_COUNT) {
+		for _, tenant := range tenants {
+			err = tree.Insert([]byte(fmt.Sprintf("%s/entity/%04d", tenant, i)), []byte(tenant))
+			assert.Nil(t, err)
+		}
+	}
+
+	for _, tenant := range tenants {
+		i := 0
+		err = tree.ScanPrefix([]byte(tenant+"/"), func(k, v []byte) bool {
+			assert.Equal(t, []byte(fmt.Sprintf("%s/entity/%04d", tenant, i)), k)
+			assert.Equal(t, []byte(tenant), v)
+			i++
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, MULTIPLE_TEST_COUNT, i)
+	}
+
+	// "b" is a prefix of the keys of both "b" and "bb".
+	count := 0
+	err = tree.ScanPrefix([]byte("b"), func(k, v []byte) bool {
+		count++
+		return count < MULTIPLE_TEST_COUNT*3/2
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, MULTIPLE_TEST_COUNT*3/2, count)
+
+	err = tree.ScanPrefix([]byte("d/"), func(k, v []byte) bool {
+		t.Fatalf("unexpected key %s", k)
+		return true
+	})
+	assert.Nil(t, err)
+}
+
+func TestIterators(t *testing.T) {
+	memFS := afero.NewMemMapFs()
+	f, err := memFS.Create("memfile")
+	assert.Nil(t, err)
+	tree, err := newTreeFromFileWithOptions(f, Options{PageSize: m_MIN_PAGE_SIZE})
+	assert.Nil(t, err)
+
+	for _, i := range mathRand.Perm(MULTIPLE_TEST_COUNT) {
+		err = tree.Insert(getPaddedKey("4", i), []byte(fmt.Sprint(i)))
+		assert.Nil(t, err)
+	}
+
+	i := 0
+	for k, v := range tree.All() {
+		assert.Equal(t, getPaddedKey("4", i), k)
+		assert.Equal(t, []byte(fmt.Sprint(i)), v)
+		i++
+	}
+	assert.Equal(t, MULTIPLE_TEST_COUNT, i)
+
+	for k, v := range tree.Backward() {
+		i--
+		assert.Equal(t, getPaddedKey("4", i), k)
+		assert.Equal(t, []byte(fmt.Sprint(i)), v)
+	}
+	assert.Equal(t, 0, i)
+
+	i = MULTIPLE_TEST_COUNT
+	for kv, err := range tree.BackwardWithErrors() {
+		assert.Nil(t, err)
+		i--
+		assert.Equal(t, getPaddedKey("4", i), kv.Key)
+		assert.Equal(t, []byte(fmt.Sprint(i)), kv.Value)
+	}
+	assert.Equal(t, 0, i)
+
+	i = 10
+	for k := range tree.Range(getPaddedKey("4", 10), getPaddedKey("4", 20)) {
+		assert.Equal(t, getPaddedKey("4", i), k)
+		i++
+	}
+	assert.Equal(t, 20, i)
+
+	// Breaking out of the loop stops the iteration.
+	keys := [][]byte{}
+	for k := range tree.All() {
+		keys = append(keys, k)
+		if len(keys) == 3 {
+			break
+		}
+	}
+	assert.Equal(t, [][]byte{getPaddedKey("4", 0), getPaddedKey("4", 1), getPaddedKey("4", 2)}, keys)
+
+	lastLeaf, err := tree.findLeaf(getPaddedKey("4", MULTIPLE_TEST_COUNT-1))
+	assert.Nil(t, err)
+	tree.Close()
+
+	fileBytes, err := afero.ReadFile(memFS, "memfile")
+	assert.Nil(t, err)
+	fileBytes[lastLeaf.Ptr+m_NODE_HEADER_SIZE] ^= 1
+	err = afero.WriteFile(memFS, "memfile", fileBytes, 0700)
+	assert.Nil(t, err)
+
+	f, err = memFS.OpenFile("memfile", os.O_RDWR, 0700)
+	assert.Nil(t, err)
+	tree, err = newTreeFromFile(f)
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	// The iteration stops at the corrupted leaf.
+	i = 0
+	for range tree.All() {
+		i++
+	}
+	assert.Less(t, i, MULTIPLE_TEST_COUNT)
+
+	// The error is yielded after the entries before the corrupted leaf.
+	j := 0
+	var iterErr error
+	for kv, err := range tree.AllWithErrors() {
+		if err != nil {
+			iterErr = err
+			continue
+		}
+
+		assert.Equal(t, getPaddedKey("4", j), kv.Key)
+		j++
+	}
+	var corruptErr *ErrCorruptPage
+	assert.True(t, errors.As(iterErr, &corruptErr))
+	assert.Equal(t, lastLeaf.Ptr, corruptErr.Ptr)
+	assert.Equal(t, i, j)
+
+	iterErr = nil
+	for _, err := range tree.RangeWithErrors(nil, getPaddedKey("4", 1)) {
+		iterErr = err
+	}
+	assert.Nil(t, iterErr)
+}
+
+// Walks the whole tree and checks that parent pointers, key order, page sizes
+// and the leaves list are consistent.
+func assertTreeIsValid(t *testing.T, tree *DiskBTree) {
+	if tree.masterPage == nil {
+		return
+	}
+
+	root, err := tree.readNode(tree.masterPage.root)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, root.Parent)
+
+	leaves := []*DiskBTreeNode{}
+	usedPages := 0
+	var walk func(node *DiskBTreeNode, low, high []byte)
+	walk = func(node *DiskBTreeNode, low, high []byte) {
+		usedPages++
+		assert.True(t, tree.fits(node), "node %d overflows", node.Ptr)
+		for i := uint16(0); i < node.Numkeys; i++ {
+			if i > 0 {
+				assert.Equal(t, -1, bytes.Compare(node.Keys[i-1], node.Keys[i]))
+			}
+
+			if low != nil {
+				assert.GreaterOrEqual(t, bytes.Compare(node.Keys[i], low), 0)
+			}
+
+			if high != nil {
+				assert.Equal(t, -1, bytes.Compare(node.Keys[i], high))
+			}
+		}
+
+		if node.IsLeaf {
+			leaves = append(leaves, node)
+			for i := uint16(0); i < node.Numkeys; i++ {
+				if ref, ok := node.Pointers[i].(overflowValue); ok {
+					usedPages += countPages(t, tree, ref.ptr, m_OVERFLOW_PAGE)
+				}
+			}
+
+			return
+		}
+
+		for i := uint16(0); i <= node.Numkeys; i++ {
+			child, err := tree.readNode(node.Pointers[i].(uint64))
+			assert.Nil(t, err)
+			assert.Equal(t, node.Ptr, child.Parent, "child %d of %d", child.Ptr, node.Ptr)
+
+			childLow, childHigh := low, high
+			if i > 0 {
+				childLow = node.Keys[i-1]
+			}
+
+			if i < node.Numkeys {
+				childHigh = node.Keys[i]
+			}
+
+			walk(child, childLow, childHigh)
+		}
+	}
+
+	walk(root, nil, nil)
+
+	count := 0
+	for i, leaf := range leaves {
+		count += int(leaf.Numkeys)
+		if i > 0 {
+			assert.Equal(t, leaves[i-1].Ptr, leaf.Prev)
+			assert.Equal(t, leaf.Ptr, leaves[i-1].Next)
+		}
+	}
+
+	assert.EqualValues(t, 0, leaves[0].Prev)
+	assert.EqualValues(t, 0, leaves[len(leaves)-1].Next)
+	assert.EqualValues(t, tree.masterPage.entryCount, count)
+
+	// Every page is either used by the tree or in the free list.
+	freePages := countPages(t, tree, tree.masterPage.freeListHead, m_FREE_PAGE)
+	assert.EqualValues(t, tree.masterPage.freePageCount, freePages)
+	assert.EqualValues(t, tree.masterPage.pageCount, usedPages+freePages)
+}
+
+// Counts the pages of a list of overflow or free pages starting at `ptr`.
+func countPages(t *testing.T, tree *DiskBTree, ptr uint64, pageType byte) int {
+	count := 0
+	for ptr != 0 {
+		pageBytes, err := tree.readPage(ptr)
+		assert.Nil(t, err)
+		assert.Equal(t, pageType, pageBytes[0])
+		ptr = binary.BigEndian.Uint64(pageBytes[1:9])
+		count++
+	}
+
+	return count
+}
+
 func toString(i int) string {
 	return fmt.Sprint(i)
 }
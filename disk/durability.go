@@ -0,0 +1,84 @@
+package disk
+
+import "time"
+
+// Durability controls when the tree waits for its files to reach stable storage.
+// Syncing is what makes a write survive a power failure, but it's also the slowest
+// part of a write.
+type Durability int
+
+const (
+	// Sync the files on every write operation. A write is durable once it returns.
+	SYNC_ON_WRITE Durability = iota
+	// Never sync the files, unless Sync is called. Writes survive the process crashing,
+	// but the OS decides when they reach the disk. The write-ahead log still keeps
+	// the file consistent as long as the OS doesn't reorder writes.
+	SYNC_NONE
+	// Group the writes of every sync interval and write them to the file together with
+	// a single sync, like in write-back mode. They are flushed in the background once
+	// the interval has passed, or earlier by Flush, Sync or Close. Writes of the current
+	// interval are lost if the process or the machine crashes, even though they returned.
+	// If a flush in the background fails, its writes are undone and the next Flush, Sync
+	// or Close returns the error. Write-back trees only flush as described for WriteBack.
+	SYNC_PERIODIC
+)
+
+const m_DEFAULT_SYNC_INTERVAL = 100 * time.Millisecond
+
+// Flushes `f` to stable storage, unless the tree doesn't sync its files.
+func (t *DiskBTree) syncFile(f DiskBTreeFile) error {
+	if t.durability == SYNC_NONE {
+		return nil
+	}
+
+	return f.Sync()
+}
+
+// Flushes the staged pages every sync interval until stopSyncing is called.
+func (t *DiskBTree) startPeriodicSync() {
+	stop, done := make(chan struct{}), make(chan struct{})
+	t.stopPeriodicSync, t.periodicSyncDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(t.syncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				t.mu.Lock()
+				if len(t.pendingPages) > 0 {
+					err := t.flush()
+					if t.periodicSyncErr == nil {
+						t.periodicSyncErr = err
+					}
+				}
+
+				t.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Stops flushing in the background and waits for a flush in progress to finish.
+// It can't hold the lock of the tree, which the flush needs, so concurrent calls are
+// made safe with a sync.Once instead.
+func (t *DiskBTree) stopSyncing() {
+	t.stopSyncingOnce.Do(func() {
+		if t.stopPeriodicSync == nil {
+			return
+		}
+
+		close(t.stopPeriodicSync)
+		<-t.periodicSyncDone
+	})
+}
+
+// Returns why the last flush in the background failed, if it did, and forgets it.
+func (t *DiskBTree) takePeriodicSyncErr() error {
+	err := t.periodicSyncErr
+	t.periodicSyncErr = nil
+
+	return err
+}
@@ -0,0 +1,65 @@
+package disk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// Encrypted pages are laid out as 12b IV, ciphertext of the page data, 16b auth tag.
+// That's why the page data size leaves room for both of them.
+
+const m_ENCRYPTION_KEY_SIZE = 32
+
+func newPageCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != m_ENCRYPTION_KEY_SIZE {
+		return nil, INVALID_ENCRYPTION_KEY_ERROR
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypts the first `dataSize` bytes of `pageBytes` with a fresh IV. The page pointer
+// is authenticated along with the data so that pages can't be swapped around.
+// Pages of unencrypted trees get a checksum instead.
+func (t *DiskBTree) sealPage(pageBytes []byte, dataSize int, ptr uint64) ([]byte, error) {
+	if t.gcm == nil {
+		return addChecksum(pageBytes, dataSize, ptr), nil
+	}
+
+	sealed := make([]byte, m_GCM_IV_SIZE, m_GCM_IV_SIZE+dataSize+m_GCM_AUTH_SIZE)
+	_, err := rand.Read(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.gcm.Seal(sealed, sealed[:m_GCM_IV_SIZE], pageBytes[:dataSize], pageAdditionalData(ptr)), nil
+}
+
+// Authenticates and decrypts a page written by sealPage and returns its data.
+// Pages of unencrypted trees have their checksum verified instead.
+func (t *DiskBTree) openPage(pageBytes []byte, dataSize int, ptr uint64) ([]byte, error) {
+	if t.gcm == nil {
+		return verifyChecksum(pageBytes, dataSize, ptr)
+	}
+
+	data, err := t.gcm.Open(nil, pageBytes[:m_GCM_IV_SIZE], pageBytes[m_GCM_IV_SIZE:], pageAdditionalData(ptr))
+	if err != nil {
+		return nil, DECRYPTION_ERROR
+	}
+
+	return data, nil
+}
+
+func pageAdditionalData(ptr uint64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, ptr)
+
+	return ad
+}
@@ -1,13 +1,46 @@
 package disk
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var KEY_NOT_FOUND_ERROR = errors.New("Key not found")
 var KEY_ALREADY_EXISTS_ERROR = errors.New("Key already exists")
 var INVALID_KEY_ERROR = errors.New("Invalid key")
 var INVALID_DATA_ERROR = errors.New("Invalid data")
 var KEY_SIZE_TOO_LARGE = errors.New("The key size is too large.")
-var INVALID_KEY_SIZE_ERROR = errors.New("Invalid key size. All keys must have the same length")
+var INVALID_KEY_SIZE_ERROR = errors.New("Invalid key size")
 var INVALID_KEY_INDEX_ERROR = errors.New("Invalid key index")
 var INVALID_POINTER_INDEX_ERROR = errors.New("Invalid pointer index")
 var TYPE_CONVERSION_ERROR = errors.New("Error while converting interface to type")
+var INVALID_FILE_ERROR = errors.New("The file is not a valid tree file or it is corrupted")
+var UNSUPPORTED_VERSION_ERROR = errors.New("The file was written with an unsupported format version")
+var INVALID_PAGE_SIZE_ERROR = errors.New("Invalid page size")
+var INVALID_ORDER_ERROR = errors.New("Invalid tree order")
+var INVALID_PAGE_TYPE_ERROR = errors.New("The page has an unexpected type")
+var NODE_SPLIT_ERROR = errors.New("Unable to split the node into two pages")
+var INVALID_ENCRYPTION_KEY_ERROR = errors.New("Invalid encryption key. The key must be 32 bytes long")
+var COPY_ON_WRITE_MISMATCH_ERROR = errors.New("The tree was created with a different copy-on-write setting")
+var TREE_TOO_LARGE_ERROR = errors.New("The tree is too large for its page table")
+var INVALID_BUFFER_POOL_SIZE_ERROR = errors.New("Invalid buffer pool size")
+var INVALID_FLUSH_THRESHOLD_ERROR = errors.New("Invalid flush threshold")
+var INVALID_DURABILITY_ERROR = errors.New("Invalid durability mode")
+var INVALID_SYNC_INTERVAL_ERROR = errors.New("Invalid sync interval")
+var MMAP_NOT_SUPPORTED_ERROR = errors.New("Memory-mapped files are only supported on Linux")
+var PREFIX_COMPRESSION_MISMATCH_ERROR = errors.New("The tree was created without prefix compression")
+var INVALID_COMPRESSOR_ERROR = errors.New("Invalid compressor. Its ID must not be 0")
+var COMPRESSOR_MISMATCH_ERROR = errors.New("The tree was created with a different compressor")
+var UNKNOWN_CODEC_ERROR = errors.New("The page was compressed with an unknown codec")
+var PAGE_OVERFLOW_ERROR = errors.New("The node doesn't fit in a page")
+var DECRYPTION_ERROR = errors.New("Unable to decrypt the page. The encryption key is wrong or the data was tampered with")
+
+// Returned when a page doesn't match its checksum, e.g. after a torn write or bit rot.
+type ErrCorruptPage struct {
+	// The pointer of the corrupted page. The master page is at 0.
+	Ptr uint64
+}
+
+func (e *ErrCorruptPage) Error() string {
+	return fmt.Sprintf("The page at %d is corrupted", e.Ptr)
+}
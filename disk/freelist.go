@@ -0,0 +1,53 @@
+package disk
+
+import (
+	"encoding/binary"
+)
+
+// Pages that are no longer used are kept in a linked list starting from the
+// master page, so that they can be reused before the file grows.
+// A free page holds 1b pageType, 8b next free page.
+
+// Returns a pointer to a page that can be written to, reusing a free page if there is one.
+func (t *DiskBTree) allocatePage() (uint64, error) {
+	if t.masterPage.freeListHead == 0 {
+		ptr := t.newPagePtr()
+		// Everytime we call newPagePtr, we need to increment the page count
+		// to avoid getting the same ptr twice.
+		t.masterPage.pageCount++
+		return ptr, nil
+	}
+
+	ptr := t.masterPage.freeListHead
+	pageBytes, err := t.readPage(ptr)
+	if err != nil {
+		return 0, err
+	}
+
+	if pageBytes[0] != m_FREE_PAGE {
+		return 0, INVALID_PAGE_TYPE_ERROR
+	}
+
+	t.masterPage.freeListHead = binary.BigEndian.Uint64(pageBytes[1:9])
+	t.masterPage.freePageCount--
+
+	return ptr, nil
+}
+
+// Adds the page at `ptr` to the free list. The master page needs to be written
+// afterwards to persist the new head of the list.
+func (t *DiskBTree) freePage(ptr uint64) error {
+	pageBytes := make([]byte, t.pageSize)
+	pageBytes[0] = m_FREE_PAGE
+	binary.BigEndian.PutUint64(pageBytes[1:9], t.masterPage.freeListHead)
+
+	err := t.writePage(pageBytes, ptr)
+	if err != nil {
+		return err
+	}
+
+	t.masterPage.freeListHead = ptr
+	t.masterPage.freePageCount++
+
+	return nil
+}
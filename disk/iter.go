@@ -0,0 +1,65 @@
+package disk
+
+import "iter"
+
+// An entry of the tree.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// Returns an iterator over the entries of the tree in key order.
+// It stops early if reading a page fails. AllWithErrors reports the error.
+func (t *DiskBTree) All() iter.Seq2[[]byte, []byte] {
+	return t.Range(nil, nil)
+}
+
+// Returns an iterator over the entries of the tree in reverse key order.
+// It stops early if reading a page fails. BackwardWithErrors reports the error.
+func (t *DiskBTree) Backward() iter.Seq2[[]byte, []byte] {
+	return func(yield func(k, v []byte) bool) {
+		t.ReverseRange(nil, nil, yield)
+	}
+}
+
+// Returns an iterator over the entries whose keys are in [lo, hi) in key order.
+// A nil bound leaves that side of the range open. The tree can be changed while
+// iterating, as with RangeWithOptions. It stops early if reading a page fails.
+// RangeWithErrors reports the error.
+func (t *DiskBTree) Range(lo, hi []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func(k, v []byte) bool) {
+		t.RangeFunc(lo, hi, yield)
+	}
+}
+
+// Like All, but if reading a page fails, the error is yielded as the last element.
+func (t *DiskBTree) AllWithErrors() iter.Seq2[KV, error] {
+	return t.RangeWithErrors(nil, nil)
+}
+
+// Like Backward, but if reading a page fails, the error is yielded as the last element.
+func (t *DiskBTree) BackwardWithErrors() iter.Seq2[KV, error] {
+	return withErrors(func(fn func(k, v []byte) bool) error {
+		return t.ReverseRange(nil, nil, fn)
+	})
+}
+
+// Like Range, but if reading a page fails, the error is yielded as the last element.
+func (t *DiskBTree) RangeWithErrors(lo, hi []byte) iter.Seq2[KV, error] {
+	return withErrors(func(fn func(k, v []byte) bool) error {
+		return t.RangeFunc(lo, hi, fn)
+	})
+}
+
+// Returns an iterator over the entries `scan` passes to its callback, followed by
+// the error scan returns if it fails.
+func withErrors(scan func(fn func(k, v []byte) bool) error) iter.Seq2[KV, error] {
+	return func(yield func(KV, error) bool) {
+		err := scan(func(k, v []byte) bool {
+			return yield(KV{Key: k, Value: v}, nil)
+		})
+		if err != nil {
+			yield(KV{}, err)
+		}
+	}
+}
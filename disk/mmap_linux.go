@@ -0,0 +1,130 @@
+package disk
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// The mapping covers at least this many bytes, and twice the file size once the file
+// grows past it, so that it doesn't have to be remapped every time a page is added.
+const m_MIN_MMAP_SIZE = 1 << 20
+
+// Serves reads from a shared mapping of the file instead of a read syscall per page.
+// Writes still go through the file and the mapping sees them through the page cache.
+// The file is remapped when it grows past the mapping, i.e. when new pages are written
+// past the end of the file.
+type mmapFile struct {
+	// Held for writing while the file is remapped.
+	mu   sync.RWMutex
+	f    *os.File
+	data []byte
+	// The size of the file, which is usually less than the size of the mapping.
+	size int64
+}
+
+func newMmapFile(f *os.File) (DiskBTreeFile, error) {
+	stats, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mmapFile{f: f}
+	err = m.grow(stats.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Sets the size of the file and remaps it if it doesn't fit in the mapping.
+func (m *mmapFile) grow(size int64) error {
+	m.size = size
+	if size <= int64(len(m.data)) && m.data != nil {
+		return nil
+	}
+
+	if m.data != nil {
+		err := syscall.Munmap(m.data)
+		if err != nil {
+			return err
+		}
+
+		m.data = nil
+	}
+
+	data, err := syscall.Mmap(int(m.f.Fd()), 0, int(max(size*2, m_MIN_MMAP_SIZE)), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+
+	m.data = data
+	return nil
+}
+
+func (m *mmapFile) ReadAt(b []byte, offset int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if offset >= m.size {
+		return 0, io.EOF
+	}
+
+	n := copy(b, m.data[offset:m.size])
+	if n < len(b) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (m *mmapFile) WriteAt(b []byte, offset int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.f.WriteAt(b, offset)
+	if end := offset + int64(n); end > m.size {
+		growErr := m.grow(end)
+		if err == nil {
+			err = growErr
+		}
+	}
+
+	return n, err
+}
+
+func (m *mmapFile) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.f.Truncate(size)
+	if err != nil {
+		return err
+	}
+
+	// Reads never go past the size, so the part of the mapping past the end of the
+	// file is never touched.
+	return m.grow(size)
+}
+
+func (m *mmapFile) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := syscall.Munmap(m.data)
+	m.data = nil
+	closeErr := m.f.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+func (m *mmapFile) Stat() (fs.FileInfo, error) {
+	return m.f.Stat()
+}
+
+// The mapping is read-only, so syncing the file is enough.
+func (m *mmapFile) Sync() error {
+	return m.f.Sync()
+}
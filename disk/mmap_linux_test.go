@@ -0,0 +1,74 @@
+package disk
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMmapFileRemapsWhenGrowing(t *testing.T) {
+	osFile, err := os.Create(filepath.Join(t.TempDir(), "mmapfile"))
+	assert.Nil(t, err)
+	f, err := newMmapFile(osFile)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	// Write past the initial mapping so that the file is remapped.
+	page := bytes.Repeat([]byte{1}, m_MIN_MMAP_SIZE/4)
+	for i := 0; i < 8; i++ {
+		page[0] = byte(i)
+		err = writeAt(f, page, int64(i*len(page)))
+		assert.Nil(t, err)
+	}
+
+	for i := 7; i >= 0; i-- {
+		res := make([]byte, len(page))
+		n, err := f.ReadAt(res, int64(i*len(page)))
+		assert.Nil(t, err)
+		assert.Equal(t, len(page), n)
+		page[0] = byte(i)
+		assert.Equal(t, page, res)
+	}
+
+	_, err = f.ReadAt(make([]byte, 1), int64(8*len(page)))
+	assert.Equal(t, io.EOF, err)
+
+	err = f.Truncate(int64(len(page)))
+	assert.Nil(t, err)
+	n, err := f.ReadAt(make([]byte, 2), int64(len(page)-1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestMmapTree(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	osFile, err := os.Create(path)
+	assert.Nil(t, err)
+	assert.Nil(t, osFile.Close())
+
+	opts := Options{PageSize: m_MIN_PAGE_SIZE, Mmap: true}
+	tree, err := NewTreeWithOptions(path, opts)
+	assert.Nil(t, err)
+	err = ascendingLoop(func(key, val []byte) error {
+		return tree.Insert(key, bytes.Repeat(val, 20))
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, tree.Close())
+
+	tree, err = NewTreeWithOptions(path, opts)
+	assert.Nil(t, err)
+	defer tree.Close()
+
+	assertTreeIsValid(t, tree)
+	err = ascendingLoop(func(key, val []byte) error {
+		res, err := tree.Find(key)
+		assert.Nil(t, err)
+		assert.Equal(t, bytes.Repeat(val, 20), res)
+		return nil
+	})
+	assert.Nil(t, err)
+}
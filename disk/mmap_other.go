@@ -0,0 +1,9 @@
+//go:build !linux
+
+package disk
+
+import "os"
+
+func newMmapFile(f *os.File) (DiskBTreeFile, error) {
+	return nil, MMAP_NOT_SUPPORTED_ERROR
+}
@@ -0,0 +1,153 @@
+package disk
+
+import (
+	"encoding/binary"
+)
+
+// 1b pageType, 8b next, 2b dataLength
+const m_OVERFLOW_HEADER_SIZE = 11
+
+// Marks a leaf value as stored in overflow pages instead of inline. Inline values
+// are always shorter than a page, so they can never have this length.
+const m_OVERFLOW_MARKER = 0xFFFF
+
+// 8b length, 8b ptr to the first overflow page
+const m_OVERFLOW_REF_SIZE = 16
+
+// A reference to a value that is too large to be stored in a leaf. The value is
+// stored in a chain of overflow pages instead, starting from `ptr`.
+type overflowValue struct {
+	ptr    uint64
+	length uint64
+}
+
+// Returns the number of value bytes one overflow page can hold.
+func (t *DiskBTree) overflowPageCapacity() int {
+	return t.pageDataSize() - m_OVERFLOW_HEADER_SIZE
+}
+
+// Entries larger than this are moved to overflow pages. It's a quarter of a
+// leaf's payload so that a leaf can always hold a few entries.
+func (t *DiskBTree) maxInlineEntrySize() int {
+	return (t.pageDataSize() - m_NODE_HEADER_SIZE) / 4
+}
+
+// Returns what needs to be stored in a leaf for `value`. Large values are written
+// to overflow pages and a reference to them is returned instead.
+func (t *DiskBTree) makeLeafPointer(key, value []byte) (interface{}, error) {
+	if entrySize(true, key, value) <= t.maxInlineEntrySize() {
+		return value, nil
+	}
+
+	return t.writeOverflowValue(value)
+}
+
+// Returns the value a leaf pointer refers to, reading it from overflow pages if needed.
+func (t *DiskBTree) readLeafPointer(pointer interface{}) ([]byte, error) {
+	switch val := pointer.(type) {
+	case []byte:
+		return val, nil
+	case overflowValue:
+		return t.readOverflowValue(val)
+	default:
+		return nil, TYPE_CONVERSION_ERROR
+	}
+}
+
+// Frees the overflow pages of a leaf pointer, if it has any.
+func (t *DiskBTree) freeLeafPointer(pointer interface{}) error {
+	val, ok := pointer.(overflowValue)
+	if !ok {
+		return nil
+	}
+
+	return t.freeOverflowValue(val)
+}
+
+func (t *DiskBTree) writeOverflowValue(value []byte) (overflowValue, error) {
+	capacity := t.overflowPageCapacity()
+	numPages := (len(value) + capacity - 1) / capacity
+	ptrs := make([]uint64, numPages)
+	for i := range ptrs {
+		ptr, err := t.allocatePage()
+		if err != nil {
+			return overflowValue{}, err
+		}
+
+		ptrs[i] = ptr
+	}
+
+	for i, ptr := range ptrs {
+		start := i * capacity
+		end := min(start+capacity, len(value))
+		next := uint64(0)
+		if i < len(ptrs)-1 {
+			next = ptrs[i+1]
+		}
+
+		pageBytes := make([]byte, t.pageSize)
+		pageBytes[0] = m_OVERFLOW_PAGE
+		binary.BigEndian.PutUint64(pageBytes[1:9], next)
+		binary.BigEndian.PutUint16(pageBytes[9:11], uint16(end-start))
+		copy(pageBytes[m_OVERFLOW_HEADER_SIZE:], value[start:end])
+
+		err := t.writePage(pageBytes, ptr)
+		if err != nil {
+			return overflowValue{}, err
+		}
+	}
+
+	return overflowValue{ptr: ptrs[0], length: uint64(len(value))}, nil
+}
+
+func (t *DiskBTree) readOverflowValue(ref overflowValue) ([]byte, error) {
+	value := make([]byte, 0, ref.length)
+	ptr := ref.ptr
+	for ptr != 0 && uint64(len(value)) < ref.length {
+		pageBytes, err := t.readPage(ptr)
+		if err != nil {
+			return nil, err
+		}
+
+		if pageBytes[0] != m_OVERFLOW_PAGE {
+			return nil, INVALID_PAGE_TYPE_ERROR
+		}
+
+		dataLength := int(binary.BigEndian.Uint16(pageBytes[9:11]))
+		if dataLength > t.overflowPageCapacity() {
+			return nil, INVALID_PAGE_TYPE_ERROR
+		}
+
+		value = append(value, pageBytes[m_OVERFLOW_HEADER_SIZE:m_OVERFLOW_HEADER_SIZE+dataLength]...)
+		ptr = binary.BigEndian.Uint64(pageBytes[1:9])
+	}
+
+	if uint64(len(value)) != ref.length {
+		return nil, INVALID_PAGE_TYPE_ERROR
+	}
+
+	return value, nil
+}
+
+func (t *DiskBTree) freeOverflowValue(ref overflowValue) error {
+	ptr := ref.ptr
+	for ptr != 0 {
+		pageBytes, err := t.readPage(ptr)
+		if err != nil {
+			return err
+		}
+
+		if pageBytes[0] != m_OVERFLOW_PAGE {
+			return INVALID_PAGE_TYPE_ERROR
+		}
+
+		err = t.freePage(ptr)
+		if err != nil {
+			return err
+		}
+
+		ptr = binary.BigEndian.Uint64(pageBytes[1:9])
+	}
+
+	return nil
+}
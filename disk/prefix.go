@@ -0,0 +1,73 @@
+package disk
+
+// With prefix compression, the prefix all keys of a node share is stored once in front
+// of the cells and the cells only hold the rest of each key. Since keys are sorted, the
+// shared prefix is the one of the first and the last key.
+//
+// Whether a change fits in a node is decided by the raw size of its keys minus what the
+// prefix saves, so nodes fill up with more keys when their keys share long prefixes.
+
+const m_PREFIX_COMPRESSION_FLAG = 2
+
+// Returns the length of the prefix all of `keys` share.
+func commonPrefixLength(keys ...[]byte) int {
+	length := len(keys[0])
+	for _, key := range keys[1:] {
+		i := 0
+		for i < length && i < len(key) && key[i] == keys[0][i] {
+			i++
+		}
+
+		length = i
+	}
+
+	return length
+}
+
+// Returns the number of bytes saved by storing the prefix shared by `numKeys` keys once,
+// instead of in every key. `keys` has to include the smallest and the largest of them.
+func (t *DiskBTree) prefixSavings(numKeys uint16, keys ...[]byte) int {
+	if !t.prefixCompression || numKeys == 0 {
+		return 0
+	}
+
+	return (int(numKeys) - 1) * commonPrefixLength(keys...)
+}
+
+// Returns the smallest and the largest key of `node`, or nothing if it's empty.
+func endKeys(node *DiskBTreeNode) [][]byte {
+	if node.Numkeys == 0 {
+		return nil
+	}
+
+	return [][]byte{node.Keys[0], node.Keys[node.Numkeys-1]}
+}
+
+// Returns the length of the prefix that is stored once when `node` is written.
+func (t *DiskBTree) nodePrefixLength(node *DiskBTreeNode) int {
+	if !t.prefixCompression || node.Numkeys == 0 {
+		return 0
+	}
+
+	return commonPrefixLength(endKeys(node)...)
+}
+
+// Returns the number of bytes `node` takes up after the header when it's written.
+func (t *DiskBTree) payloadSize(node *DiskBTreeNode) int {
+	return node.payloadSize() - t.prefixSavings(node.Numkeys, endKeys(node)...)
+}
+
+// Reports whether `node` still fits after its key at `idx` is replaced with `key`.
+func (t *DiskBTree) canReplaceKey(node *DiskBTreeNode, idx int, key []byte) bool {
+	first, last := node.Keys[0], node.Keys[node.Numkeys-1]
+	if idx == 0 {
+		first = key
+	}
+
+	if idx == int(node.Numkeys)-1 {
+		last = key
+	}
+
+	payloadSize := node.payloadSize() - len(node.Keys[idx]) + len(key) - t.prefixSavings(node.Numkeys, first, last)
+	return t.nodeFits(node.Numkeys, payloadSize)
+}
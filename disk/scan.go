@@ -0,0 +1,95 @@
+package disk
+
+import "bytes"
+
+// How the bounds of a range scan are treated.
+type RangeOptions struct {
+	// Skip the entry whose key is the start bound.
+	ExcludeStart bool
+	// Include the entry whose key is the end bound.
+	IncludeEnd bool
+}
+
+// Calls `fn` with the entries whose keys are in [start, end) in key order, until it
+// returns false. A nil bound leaves that side of the range open.
+func (t *DiskBTree) RangeFunc(start, end []byte, fn func(k, v []byte) bool) error {
+	return t.RangeWithOptions(start, end, RangeOptions{}, fn)
+}
+
+// Like RangeFunc, but `opts` decides whether the bounds themselves are in the range.
+// The tree is only locked while reading pages, so it can be changed by `fn`. The scan
+// continues after the last key it passed to fn.
+func (t *DiskBTree) RangeWithOptions(start, end []byte, opts RangeOptions, fn func(k, v []byte) bool) error {
+	cursor := t.Cursor()
+	ok := cursor.Seek(start)
+	if ok && !opts.afterStart(cursor.Key(), start) {
+		ok = cursor.Next()
+	}
+
+	for ; ok && opts.beforeEnd(cursor.Key(), end); ok = cursor.Next() {
+		if !fn(cursor.Key(), cursor.Value()) {
+			return nil
+		}
+	}
+
+	return cursor.Err()
+}
+
+// Like RangeFunc, but the entries are passed to `fn` in reverse key order, starting
+// from the end bound.
+func (t *DiskBTree) ReverseRange(start, end []byte, fn func(k, v []byte) bool) error {
+	return t.ReverseRangeWithOptions(start, end, RangeOptions{}, fn)
+}
+
+// Like RangeWithOptions, but the entries are passed to `fn` in reverse key order.
+func (t *DiskBTree) ReverseRangeWithOptions(start, end []byte, opts RangeOptions, fn func(k, v []byte) bool) error {
+	cursor := t.Cursor()
+	ok := end != nil && cursor.Seek(end)
+	if ok && !opts.beforeEnd(cursor.Key(), end) {
+		ok = cursor.Prev()
+	} else if !ok && cursor.Err() == nil {
+		// Every key is before the end bound.
+		ok = cursor.Last()
+	}
+
+	for ; ok && opts.afterStart(cursor.Key(), start); ok = cursor.Prev() {
+		if !fn(cursor.Key(), cursor.Value()) {
+			return nil
+		}
+	}
+
+	return cursor.Err()
+}
+
+// Calls `fn` with the entries whose keys start with `prefix` in key order, until it
+// returns false.
+func (t *DiskBTree) ScanPrefix(prefix []byte, fn func(k, v []byte) bool) error {
+	cursor := t.Cursor()
+	for ok := cursor.Seek(prefix); ok && bytes.HasPrefix(cursor.Key(), prefix); ok = cursor.Next() {
+		if !fn(cursor.Key(), cursor.Value()) {
+			return nil
+		}
+	}
+
+	return cursor.Err()
+}
+
+// Reports whether `key` comes before the end bound `end`.
+func (opts RangeOptions) beforeEnd(key, end []byte) bool {
+	if end == nil {
+		return true
+	}
+
+	cmp := bytes.Compare(key, end)
+	return cmp < 0 || (cmp == 0 && opts.IncludeEnd)
+}
+
+// Reports whether `key` comes after the start bound `start`.
+func (opts RangeOptions) afterStart(key, start []byte) bool {
+	if start == nil {
+		return true
+	}
+
+	cmp := bytes.Compare(key, start)
+	return cmp > 0 || (cmp == 0 && !opts.ExcludeStart)
+}
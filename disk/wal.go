@@ -0,0 +1,279 @@
+package disk
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+	"time"
+)
+
+// Every write operation collects the pages it changes, including the master page,
+// instead of writing them in place. Once the operation is done, all of its pages are
+// written to the write-ahead log as one record and synced before any of them is written
+// to the db file. If we crash while writing the db file, the record is replayed the next
+// time the tree is opened. Incomplete records are discarded, which leaves the tree as it
+// was before the operation.
+//
+// A record consists of 4b magic, 4b numPages, numPages * (8b ptr, 4b length, page),
+// 4b CRC32C checksum of everything before it. Bytes after the checksum are left over
+// from an earlier, longer record and are ignored.
+//
+// The master page is written to the db file last, so that the file keeps pointing to
+// the previous version of the tree until all of the new pages are written.
+
+// Identifies a write-ahead log record. It's the ascii encoding of "BPTW".
+const m_WAL_MAGIC_NUMBER = 0x42505457
+const m_WAL_HEADER_SIZE = 8
+const m_WAL_PAGE_HEADER_SIZE = 12
+
+// Called at the end of every write operation with the error it returned. If the operation
+// failed, the tree goes back to how it was before the operation. Otherwise its pages are
+// written to the file, unless they are written back later.
+func (t *DiskBTree) finishWrite(err error) error {
+	if err != nil {
+		t.undoWrite()
+		return err
+	}
+
+	if t.canDeferFlush() {
+		return nil
+	}
+
+	return t.flush()
+}
+
+// Writes the pending pages to the log and then to the db file.
+func (t *DiskBTree) commit() error {
+	if len(t.pendingPages) == 0 {
+		return nil
+	}
+
+	if t.copyOnWrite {
+		return t.commitCopyOnWrite()
+	}
+
+	_, masterPageWritten := t.pendingPages[t.nextMasterPageSlot()]
+	ptrs := writeOrder(t.pendingPages)
+	if t.walFile != nil {
+		err := writeAt(t.walFile, t.walRecord(ptrs), 0)
+		if err != nil {
+			return err
+		}
+
+		err = t.syncFile(t.walFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, ptr := range ptrs {
+		err := writeAt(t.dbFile, t.pendingPages[ptr], int64(ptr))
+		if err != nil {
+			return err
+		}
+	}
+
+	t.pendingPages = make(map[uint64][]byte)
+	if masterPageWritten {
+		t.masterPage.sequence++
+	}
+
+	err := t.syncFile(t.dbFile)
+	if err != nil {
+		return err
+	}
+
+	t.lastSync = time.Now()
+	if t.walFile == nil {
+		return nil
+	}
+
+	return t.walFile.Truncate(0)
+}
+
+// Drops the pending pages and reads the master page again. It's used when writing
+// the pending pages fails, since we don't know what made it to the file. In copy-on-write
+// mode, nothing is visible until the master page is written, so that's all we need. If
+// the commit failed while writing the db file, its record is replayed so that the file
+// isn't left half written, i.e. the changes might have taken effect even though it failed.
+// If the replay fails too, the master page of the previous version is read and the record
+// is replayed again before the next write operation.
+func (t *DiskBTree) rollback() error {
+	t.changes++
+	t.pendingPages = make(map[uint64][]byte)
+	t.bufferPool.clear()
+	var replayErr error
+	if t.walFile != nil && !t.copyOnWrite {
+		replayErr = t.replayWAL()
+		t.walNeedsReplay = replayErr != nil
+	}
+
+	err := t.reloadMasterPage()
+	if err != nil {
+		return err
+	}
+
+	return replayErr
+}
+
+// Replays the record that rollback failed to replay, so that the next write operation
+// starts from the tree the record leaves behind.
+func (t *DiskBTree) replayFailedCommit() error {
+	if !t.walNeedsReplay {
+		return nil
+	}
+
+	err := t.replayWAL()
+	if err != nil {
+		return err
+	}
+
+	t.walNeedsReplay = false
+	t.changes++
+	t.bufferPool.clear()
+
+	return t.reloadMasterPage()
+}
+
+// Reads the master page and the page table of the tree from the file again.
+func (t *DiskBTree) reloadMasterPage() error {
+	stats, err := t.dbFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stats.Size() == 0 {
+		t.masterPage = nil
+		t.resetPageTable()
+		return nil
+	}
+
+	err = t.readMasterPage()
+	if err != nil && t.masterPage != nil && t.masterPage.sequence == 0 {
+		// The first commit failed before its master page was written, so the tree is
+		// still empty.
+		t.masterPage = nil
+		t.resetPageTable()
+		return t.dbFile.Truncate(0)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if t.copyOnWrite {
+		return t.loadPageTable()
+	}
+
+	return nil
+}
+
+func (t *DiskBTree) walRecord(ptrs []uint64) []byte {
+	size := m_WAL_HEADER_SIZE + crc32.Size
+	for _, ptr := range ptrs {
+		size += m_WAL_PAGE_HEADER_SIZE + len(t.pendingPages[ptr])
+	}
+
+	record := make([]byte, m_WAL_HEADER_SIZE, size)
+	binary.BigEndian.PutUint32(record[0:4], m_WAL_MAGIC_NUMBER)
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(ptrs)))
+	for _, ptr := range ptrs {
+		record = binary.BigEndian.AppendUint64(record, ptr)
+		record = binary.BigEndian.AppendUint32(record, uint32(len(t.pendingPages[ptr])))
+		record = append(record, t.pendingPages[ptr]...)
+	}
+
+	return binary.BigEndian.AppendUint32(record, crc32.Checksum(record, castagnoliTable))
+}
+
+// Applies the record left in the log by an interrupted commit, if it's complete,
+// and empties the log.
+func (t *DiskBTree) replayWAL() error {
+	stats, err := t.walFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stats.Size() == 0 {
+		return nil
+	}
+
+	record := make([]byte, stats.Size())
+	n, err := t.walFile.ReadAt(record, 0)
+	if n != len(record) {
+		return err
+	}
+
+	pages, ok := parseWALRecord(record)
+	if ok {
+		for _, ptr := range writeOrder(pages) {
+			err = writeAt(t.dbFile, pages[ptr], int64(ptr))
+			if err != nil {
+				return err
+			}
+		}
+
+		err = t.syncFile(t.dbFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.walFile.Truncate(0)
+}
+
+// Returns the pages of the record at the start of `record` and whether it's a complete record.
+func parseWALRecord(record []byte) (map[uint64][]byte, bool) {
+	if len(record) < m_WAL_HEADER_SIZE+crc32.Size || binary.BigEndian.Uint32(record[0:4]) != m_WAL_MAGIC_NUMBER {
+		return nil, false
+	}
+
+	numPages := binary.BigEndian.Uint32(record[4:8])
+	pages := make(map[uint64][]byte)
+	start := m_WAL_HEADER_SIZE
+	for i := uint32(0); i < numPages; i++ {
+		if start+m_WAL_PAGE_HEADER_SIZE > len(record) {
+			return nil, false
+		}
+
+		ptr := binary.BigEndian.Uint64(record[start : start+8])
+		length := int(binary.BigEndian.Uint32(record[start+8 : start+12]))
+		start += m_WAL_PAGE_HEADER_SIZE
+		if length > len(record)-start {
+			return nil, false
+		}
+
+		pages[ptr] = record[start : start+length]
+		start += length
+	}
+
+	if start+crc32.Size > len(record) ||
+		binary.BigEndian.Uint32(record[start:start+crc32.Size]) != crc32.Checksum(record[:start], castagnoliTable) {
+		return nil, false
+	}
+
+	return pages, true
+}
+
+// Returns the ptrs of `pages` in the order they're written to the db file, i.e. sorted
+// with the master page slots last.
+func writeOrder(pages map[uint64][]byte) []uint64 {
+	ptrs := sortedKeys(pages)
+	masterPages := 0
+	for masterPages < len(ptrs) && ptrs[masterPages] < m_DATA_OFFSET {
+		masterPages++
+	}
+
+	return append(append([]uint64(nil), ptrs[masterPages:]...), ptrs[:masterPages]...)
+}
+
+func sortedKeys(pages map[uint64][]byte) []uint64 {
+	ptrs := make([]uint64, 0, len(pages))
+	for ptr := range pages {
+		ptrs = append(ptrs, ptr)
+	}
+
+	sort.Slice(ptrs, func(i, j int) bool { return ptrs[i] < ptrs[j] })
+
+	return ptrs
+}
@@ -0,0 +1,105 @@
+package disk
+
+import "time"
+
+// Pages written by an operation are staged in memory and written to the file together.
+// By default that happens at the end of every operation. In write-back mode, staged
+// pages are kept across operations and only written on Flush, Sync or Close, or once
+// there are more than the flush threshold. A page changed by many operations in between
+// is written only once.
+//
+// Since staged pages can belong to earlier operations, a failed operation can't just
+// drop them. Instead, every operation keeps what it replaced so that it can be undone.
+
+const m_DEFAULT_FLUSH_THRESHOLD = 1024
+
+// Whether the pages staged so far can wait to be written with the ones of later operations.
+func (t *DiskBTree) canDeferFlush() bool {
+	if len(t.pendingPages) >= t.flushThreshold {
+		return false
+	}
+
+	if t.writeBack {
+		return true
+	}
+
+	return t.durability == SYNC_PERIODIC && time.Since(t.lastSync) < t.syncInterval
+}
+
+// Called at the start of every write operation.
+func (t *DiskBTree) beginWrite() {
+	t.changes++
+	t.undoPages = make(map[uint64][]byte)
+	t.undoMasterPage = nil
+	if t.masterPage != nil {
+		mp := *t.masterPage
+		mp.tableDir = append([]uint64(nil), mp.tableDir...)
+		t.undoMasterPage = &mp
+	}
+}
+
+// Stages `pageBytes` to be written to `ptr`.
+func (t *DiskBTree) stagePage(pageBytes []byte, ptr uint64) {
+	if _, ok := t.undoPages[ptr]; !ok {
+		// nil if the page wasn't staged before the operation.
+		t.undoPages[ptr] = t.pendingPages[ptr]
+	}
+
+	t.pendingPages[ptr] = pageBytes
+	t.bufferPool.remove(ptr)
+}
+
+// Puts back the staged pages and the master page as they were before the current operation.
+func (t *DiskBTree) undoWrite() {
+	for ptr, pageBytes := range t.undoPages {
+		if pageBytes == nil {
+			delete(t.pendingPages, ptr)
+		} else {
+			t.pendingPages[ptr] = pageBytes
+		}
+	}
+
+	t.masterPage = t.undoMasterPage
+	t.undoPages = make(map[uint64][]byte)
+	t.bufferPool.clear()
+}
+
+// Writes every staged page to the file.
+func (t *DiskBTree) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.flush()
+	if periodicErr := t.takePeriodicSyncErr(); periodicErr != nil {
+		return periodicErr
+	}
+
+	return err
+}
+
+func (t *DiskBTree) flush() error {
+	err := t.commit()
+	if err != nil {
+		rollbackErr := t.rollback()
+		if rollbackErr != nil {
+			return rollbackErr
+		}
+	}
+
+	return err
+}
+
+// Writes every staged page to the file and waits until the file is on stable storage.
+func (t *DiskBTree) Sync() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.flush()
+	if err == nil {
+		err = t.dbFile.Sync()
+	}
+
+	if periodicErr := t.takePeriodicSyncErr(); periodicErr != nil {
+		return periodicErr
+	}
+
+	return err
+}
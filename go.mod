@@ -1,8 +1,6 @@
 module github.com/Aasim-A/bptree
 
-go 1.21.0
-
-toolchain go1.22.1
+go 1.23.0
 
 require (
 	github.com/spf13/afero v1.11.0
@@ -0,0 +1,158 @@
+package memory
+
+import "bytes"
+
+// Walks the entries of a tree in key order by following the links between leaves.
+// A cursor starts out invalid. It's positioned with First, Last or Seek and moved with
+// Next and Prev. Changes made to the tree after a move are seen by the next move,
+// which continues from the key the cursor is at.
+type Cursor struct {
+	tree *BTree
+	leaf *BTreeNode
+	idx  int
+	// The number of changes to the tree when the cursor was positioned.
+	changes uint64
+	key     []byte
+	value   []byte
+}
+
+// Returns a new cursor over the entries of the tree.
+func (t *BTree) Cursor() *Cursor {
+	return &Cursor{tree: t}
+}
+
+// Moves to the first entry of the tree. Returns false if the tree is empty.
+func (c *Cursor) First() bool {
+	if c.tree.root == nil {
+		return c.set(nil, 0)
+	}
+
+	leaf := c.tree.root
+	for !leaf.IsLeaf {
+		leaf = leaf.Pointers[0].(*BTreeNode)
+	}
+
+	return c.forward(leaf, 0)
+}
+
+// Moves to the last entry of the tree. Returns false if the tree is empty.
+func (c *Cursor) Last() bool {
+	if c.tree.root == nil {
+		return c.set(nil, 0)
+	}
+
+	leaf := c.tree.root
+	for !leaf.IsLeaf {
+		leaf = leaf.Pointers[leaf.Numkeys].(*BTreeNode)
+	}
+
+	return c.backward(leaf, leaf.Numkeys-1)
+}
+
+// Moves to the first entry whose key is greater than or equal to `key`.
+// Returns false if there is no such entry.
+func (c *Cursor) Seek(key []byte) bool {
+	leaf, idx := c.tree.seek(key)
+	return c.forward(leaf, idx)
+}
+
+// Moves to the next entry. Returns false if the cursor was at the last entry or invalid.
+func (c *Cursor) Next() bool {
+	if c.leaf == nil {
+		return false
+	}
+
+	if c.changes == c.tree.changes {
+		return c.forward(c.leaf, c.idx+1)
+	}
+
+	leaf, idx := c.tree.seek(c.key)
+	if leaf != nil && idx < leaf.Numkeys && bytes.Equal(leaf.Keys[idx], c.key) {
+		idx++
+	}
+
+	return c.forward(leaf, idx)
+}
+
+// Moves to the previous entry. Returns false if the cursor was at the first entry or invalid.
+func (c *Cursor) Prev() bool {
+	if c.leaf == nil {
+		return false
+	}
+
+	if c.changes == c.tree.changes {
+		return c.backward(c.leaf, c.idx-1)
+	}
+
+	leaf, idx := c.tree.seek(c.key)
+	return c.backward(leaf, idx-1)
+}
+
+// Reports whether the cursor is at an entry.
+func (c *Cursor) Valid() bool {
+	return c.leaf != nil
+}
+
+// Returns the key of the current entry, or nil if the cursor is invalid.
+func (c *Cursor) Key() []byte {
+	return c.key
+}
+
+// Returns the value of the current entry, or nil if the cursor is invalid.
+func (c *Cursor) Value() []byte {
+	return c.value
+}
+
+// Returns the leaf `key` belongs in and the index of the first key in it that
+// is greater than or equal to `key`. The index is Numkeys if there is none.
+func (t *BTree) seek(key []byte) (*BTreeNode, int) {
+	if t.root == nil {
+		return nil, 0
+	}
+
+	leaf := t.root
+	for !leaf.IsLeaf {
+		leaf = leaf.Pointers[getInsertionIndex(leaf, key)].(*BTreeNode)
+	}
+
+	idx := 0
+	for idx < leaf.Numkeys && bytes.Compare(leaf.Keys[idx], key) < 0 {
+		idx++
+	}
+
+	return leaf, idx
+}
+
+// Moves to the entry at `idx` in `leaf`, or to the first entry after it if there is none.
+func (c *Cursor) forward(leaf *BTreeNode, idx int) bool {
+	for leaf != nil && idx >= leaf.Numkeys {
+		leaf, idx = leaf.Next, 0
+	}
+
+	return c.set(leaf, idx)
+}
+
+// Moves to the entry at `idx` in `leaf`, or to the last entry before it if there is none.
+func (c *Cursor) backward(leaf *BTreeNode, idx int) bool {
+	for leaf != nil && idx < 0 {
+		leaf = leaf.Prev
+		if leaf != nil {
+			idx = leaf.Numkeys - 1
+		}
+	}
+
+	return c.set(leaf, idx)
+}
+
+func (c *Cursor) set(leaf *BTreeNode, idx int) bool {
+	c.leaf, c.idx, c.changes = leaf, idx, c.tree.changes
+	if leaf == nil {
+		c.key, c.value = nil, nil
+		return false
+	}
+
+	c.key = leaf.Keys[idx]
+	c.value, _ = leaf.Pointers[idx].([]byte)
+
+	return true
+}
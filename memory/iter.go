@@ -0,0 +1,24 @@
+package memory
+
+import "iter"
+
+// Returns an iterator over the entries of the tree in key order.
+func (t *BTree) All() iter.Seq2[[]byte, []byte] {
+	return t.Range(nil, nil)
+}
+
+// Returns an iterator over the entries of the tree in reverse key order.
+func (t *BTree) Backward() iter.Seq2[[]byte, []byte] {
+	return func(yield func(k, v []byte) bool) {
+		t.ReverseRange(nil, nil, yield)
+	}
+}
+
+// Returns an iterator over the entries whose keys are in [lo, hi) in key order.
+// A nil bound leaves that side of the range open. The tree can be changed while
+// iterating, as with RangeWithOptions.
+func (t *BTree) Range(lo, hi []byte) iter.Seq2[[]byte, []byte] {
+	return func(yield func(k, v []byte) bool) {
+		t.RangeFunc(lo, hi, yield)
+	}
+}
@@ -8,14 +8,37 @@ import (
 
 // Returns a pointer to a new in-memory B+ tree
 func NewTree() *BTree {
-	return &BTree{root: nil}
+	tree, _ := NewTreeWithOptions(Options{})
+	return tree
+}
+
+// Returns a pointer to a new in-memory B+ tree configured with `opts`
+func NewTreeWithOptions(opts Options) (*BTree, error) {
+	order := opts.Order
+	if order == 0 {
+		order = m_DEFAULT_ORDER
+	}
+
+	if order < m_MIN_ORDER {
+		return nil, INVALID_ORDER_ERROR
+	}
+
+	return &BTree{
+		root:  nil,
+		order: order,
+		// Ceil the division. eg. 7/2 = 3, 7%2 = 1. 3+1 = 4.
+		orderHalf: order/2 + (order % 2),
+	}, nil
 }
 
 // Order must not be less than 4.
-const m_ORDER = 4
+const m_MIN_ORDER = 4
+const m_DEFAULT_ORDER = 4
 
-// Ceil the division. eg. 7/2 = 3, 7%2 = 1. 3+1 = 4.
-const m_ORDER_HALF = m_ORDER/2 + (m_ORDER % 2)
+type Options struct {
+	// The maximum number of children of a node. Zero means the default order.
+	Order int
+}
 
 type Record struct {
 	Value []byte
@@ -32,8 +55,12 @@ type BTreeNode struct {
 }
 
 type BTree struct {
-	root    *BTreeNode
-	keySize int
+	root      *BTreeNode
+	order     int
+	orderHalf int
+	// Counts the inserts and deletes, so that cursors know when the leaves they're at
+	// might have changed.
+	changes uint64
 }
 
 // Find the value associated with a key
@@ -43,10 +70,6 @@ func (t *BTree) Find(key []byte) ([]byte, error) {
 		return nil, KEY_NOT_FOUND_ERROR
 	}
 
-	if len(key) != t.keySize {
-		return nil, INVALID_KEY_SIZE_ERROR
-	}
-
 	leaf, err := t.findLeaf(key)
 	if err != nil {
 		return nil, err
@@ -72,10 +95,6 @@ func (t *BTree) Update(key, newValue []byte) error {
 		return KEY_NOT_FOUND_ERROR
 	}
 
-	if len(key) != t.keySize {
-		return INVALID_KEY_SIZE_ERROR
-	}
-
 	leaf, err := t.findLeaf(key)
 	if err != nil {
 		return err
@@ -102,6 +121,8 @@ func (t *BTree) Insert(key, value []byte) error {
 		return INVALID_KEY_SIZE_ERROR
 	}
 
+	t.changes++
+
 	leaf, err := t.findLeaf(key)
 	if err == nil {
 		idx := getKeyIndex(leaf, key)
@@ -111,20 +132,15 @@ func (t *BTree) Insert(key, value []byte) error {
 	}
 
 	if t.root == nil {
-		t.root = makeLeaf()
+		t.root = t.makeLeaf()
 		t.root.Keys[0] = key
 		t.root.Pointers[0] = value
 		t.root.Numkeys++
-		t.keySize = len(key)
 
 		return nil
 	}
 
-	if len(key) != t.keySize {
-		return INVALID_KEY_SIZE_ERROR
-	}
-
-	if leaf.Numkeys < m_ORDER-1 {
+	if leaf.Numkeys < t.order-1 {
 		insertIntoNode(leaf, key, value)
 		return nil
 	}
@@ -149,6 +165,7 @@ func (t *BTree) Delete(key []byte) error {
 		return KEY_NOT_FOUND_ERROR
 	}
 
+	t.changes++
 	return t.deleteEntry(leaf, key, leaf.Pointers[idx])
 }
 
@@ -280,18 +297,22 @@ func (t *BTree) findLeaf(key []byte) (*BTreeNode, error) {
 func (t *BTree) recursivelySplitAndInsert(node *BTreeNode, key []byte, pointer interface{}) error {
 	var newNode *BTreeNode
 	if node.IsLeaf {
-		newNode = makeLeaf()
+		newNode = t.makeLeaf()
 		newNode.Next = node.Next
 		newNode.Prev = node
 		node.Next = newNode
+		if newNode.Next != nil {
+			// The leaf after node needs to point back to newNode since it's now between them.
+			newNode.Next.Prev = newNode
+		}
 	} else {
-		newNode = makeNode()
+		newNode = t.makeNode()
 	}
 
 	newNode.Parent = node.Parent
 	tempNode := &BTreeNode{
-		Keys:     make([][]byte, m_ORDER),
-		Pointers: make([]interface{}, m_ORDER+1),
+		Keys:     make([][]byte, t.order),
+		Pointers: make([]interface{}, t.order+1),
 		IsLeaf:   node.IsLeaf,
 		Numkeys:  node.Numkeys,
 	}
@@ -308,9 +329,9 @@ func (t *BTree) recursivelySplitAndInsert(node *BTreeNode, key []byte, pointer i
 	insertIntoNode(tempNode, key, pointer)
 	// Reset numkeys to reflect new content.
 	node.Numkeys = 0
-	node.Keys = make([][]byte, m_ORDER-1)
-	node.Pointers = make([]interface{}, m_ORDER)
-	for i = 0; i < m_ORDER_HALF; i++ {
+	node.Keys = make([][]byte, t.order-1)
+	node.Pointers = make([]interface{}, t.order)
+	for i = 0; i < t.orderHalf; i++ {
 		node.Keys[i] = tempNode.Keys[i]
 		node.Pointers[i] = tempNode.Pointers[i]
 		node.Numkeys++
@@ -324,13 +345,13 @@ func (t *BTree) recursivelySplitAndInsert(node *BTreeNode, key []byte, pointer i
 		nodePointerAdjustment = 1
 	}
 
-	for i = m_ORDER_HALF; i < m_ORDER; i++ {
+	for i = t.orderHalf; i < t.order; i++ {
 		if node.IsLeaf {
-			newNode.Keys[i-m_ORDER_HALF] = tempNode.Keys[i]
+			newNode.Keys[i-t.orderHalf] = tempNode.Keys[i]
 			newNode.Numkeys++
 		} else {
-			if i > m_ORDER_HALF {
-				newNode.Keys[i-m_ORDER_HALF-1] = tempNode.Keys[i]
+			if i > t.orderHalf {
+				newNode.Keys[i-t.orderHalf-1] = tempNode.Keys[i]
 				newNode.Numkeys++
 			}
 
@@ -341,39 +362,32 @@ func (t *BTree) recursivelySplitAndInsert(node *BTreeNode, key []byte, pointer i
 
 			ptr.Parent = newNode
 		}
-		newNode.Pointers[i-m_ORDER_HALF] = tempNode.Pointers[i+nodePointerAdjustment]
+		newNode.Pointers[i-t.orderHalf] = tempNode.Pointers[i+nodePointerAdjustment]
 	}
 
-	if node == t.root {
-		t.splitRootAndInsert(node, newNode, tempNode.Keys[m_ORDER_HALF])
-		return nil
+	keyToAddToParent := tempNode.Keys[t.orderHalf]
+	if node.IsLeaf {
+		// Non leaf nodes only need a key that separates the two leaves, which
+		// is usually much shorter than the first key of newNode.
+		keyToAddToParent = separator(node.Keys[node.Numkeys-1], newNode.Keys[0])
 	}
 
-	if node.Parent.Numkeys < m_ORDER-1 {
-		if node.IsLeaf {
-			insertIntoNode(node.Parent, newNode.Keys[0], newNode)
-			return nil
-		}
-
-		insertIntoNode(node.Parent, tempNode.Keys[m_ORDER_HALF], newNode)
+	if node == t.root {
+		t.splitRootAndInsert(node, newNode, keyToAddToParent)
 		return nil
 	}
 
-	if node.IsLeaf {
-		return t.recursivelySplitAndInsert(node.Parent, newNode.Keys[0], newNode)
+	if node.Parent.Numkeys < t.order-1 {
+		insertIntoNode(node.Parent, keyToAddToParent, newNode)
+		return nil
 	}
 
-	return t.recursivelySplitAndInsert(node.Parent, tempNode.Keys[m_ORDER_HALF], newNode)
+	return t.recursivelySplitAndInsert(node.Parent, keyToAddToParent, newNode)
 }
 
-func (t *BTree) splitRootAndInsert(node, newNode *BTreeNode, nonLeafKeyToAddToParent []byte) {
-	newParent := makeNode()
-	if node.IsLeaf {
-		newParent.Keys[0] = newNode.Keys[0]
-	} else {
-		newParent.Keys[0] = nonLeafKeyToAddToParent
-	}
-
+func (t *BTree) splitRootAndInsert(node, newNode *BTreeNode, keyToAddToParent []byte) {
+	newParent := t.makeNode()
+	newParent.Keys[0] = keyToAddToParent
 	newParent.Pointers[0] = node
 	newParent.Pointers[1] = newNode
 	newParent.Numkeys++
@@ -392,7 +406,7 @@ func (t *BTree) deleteEntry(node *BTreeNode, key []byte, pointer interface{}) er
 		return t.adjustRoot()
 	}
 
-	minKeys := m_ORDER_HALF - 1
+	minKeys := t.orderHalf - 1
 	// We subtracted 1 to avoid '>='
 	if node.Numkeys > minKeys-1 {
 		return nil
@@ -540,14 +554,14 @@ func borrowFromSibling(node, sibling *BTreeNode, isLeftSibling bool, kPrime []by
 		// Since this is a leaf node, we don't need to use `kPrime`.
 		node.Keys[0] = sibling.Keys[sibling.Numkeys-1]
 		node.Pointers[0] = sibling.Pointers[sibling.Numkeys-1]
-		// We need to update the parent's key to the newly inserted key
-		// since it'll be placed in index 0.
-		node.Parent.Keys[kPrimeIdx] = node.Keys[0]
 		node.Numkeys++
 		// Set the borrowed key & pointer to nil.
 		sibling.Keys[sibling.Numkeys-1] = nil
 		sibling.Pointers[sibling.Numkeys-1] = nil
 		sibling.Numkeys--
+		// We need to update the parent's key since the newly inserted key
+		// is placed in index 0.
+		node.Parent.Keys[kPrimeIdx] = separator(sibling.Keys[sibling.Numkeys-1], node.Keys[0])
 
 		return nil
 	}
@@ -557,7 +571,7 @@ func borrowFromSibling(node, sibling *BTreeNode, isLeftSibling bool, kPrime []by
 	node.Pointers[node.Numkeys] = sibling.Pointers[0]
 	// Updating the key is required since sibling's index 0 key is changing.
 	// Sibling's index 1 key will become index 0 key after shifting.
-	node.Parent.Keys[kPrimeIdx] = sibling.Keys[1]
+	node.Parent.Keys[kPrimeIdx] = separator(sibling.Keys[0], sibling.Keys[1])
 	node.Numkeys++
 	// Shifting sibling's keys & pointers to the left by one.
 	for i := 0; i < sibling.Numkeys-1; i++ {
@@ -615,6 +629,13 @@ func (t *BTree) mergeNodes(node, sibling *BTreeNode, isLeftSibling bool, kPrime
 			sibling.Pointers[i] = node.Pointers[j]
 			i++
 		}
+
+		// node is being removed from the leaves list, so the leaf after it
+		// needs to point back to sibling.
+		sibling.Next = node.Next
+		if node.Next != nil {
+			node.Next.Prev = sibling
+		}
 	}
 
 	sibling.Numkeys += node.Numkeys
@@ -666,11 +687,11 @@ func removeFromNode(node *BTreeNode, key []byte, pointer interface{}) error {
 	return nil
 }
 
-func makeNode() *BTreeNode {
+func (t *BTree) makeNode() *BTreeNode {
 	return &BTreeNode{
-		Keys:     make([][]byte, m_ORDER-1),
+		Keys:     make([][]byte, t.order-1),
 		Numkeys:  0,
-		Pointers: make([]interface{}, m_ORDER),
+		Pointers: make([]interface{}, t.order),
 		IsLeaf:   false,
 		Parent:   nil,
 		Next:     nil,
@@ -678,8 +699,8 @@ func makeNode() *BTreeNode {
 	}
 }
 
-func makeLeaf() *BTreeNode {
-	node := makeNode()
+func (t *BTree) makeLeaf() *BTreeNode {
+	node := t.makeNode()
 	node.IsLeaf = true
 
 	return node
@@ -702,6 +723,17 @@ func insertIntoNode(node *BTreeNode, key []byte, pointer interface{}) {
 	node.Numkeys++
 }
 
+// Returns the shortest key that is greater than `left` and not greater than `right`,
+// which is all a non leaf node needs to separate them. `left` must be less than `right`.
+func separator(left, right []byte) []byte {
+	i := 0
+	for i < len(left) && left[i] == right[i] {
+		i++
+	}
+
+	return bytes.Clone(right[:i+1])
+}
+
 // Gets the index that `key` needs to be inserted into.
 // Returns -1 if `node` or `key` is nil.
 func getInsertionIndex(node *BTreeNode, key []byte) int {
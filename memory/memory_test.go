@@ -1,11 +1,13 @@
 package memory
 
 import (
+	"bytes"
 	rand "crypto/rand"
 	"errors"
 	"fmt"
 	mathRand "math/rand"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -71,23 +73,27 @@ func TestInsertNilRoot(t *testing.T) {
 
 func TestInsertVariableKeySize(t *testing.T) {
 	tree := NewTree()
-	key1, key2, val := []byte("1"), []byte("key 2"), []byte("v1")
-	err := tree.Insert(key1, val)
-	if err != nil {
-		t.Fatal(err)
+	keys := [][]byte{[]byte("1"), []byte("key 2"), []byte(""), bytes.Repeat([]byte("k"), 80)}
+	for i := 0; i < MULTIPLE_TEST_COUNT; i++ {
+		keys = append(keys, []byte(strings.Repeat("k", i%7)+fmt.Sprint(i)))
 	}
 
-	if len(key1) != tree.keySize {
-		t.Fatalf("Expected keySize to be %d but got %d", len(key1), tree.keySize)
+	for i, key := range keys {
+		err := tree.Insert(key, []byte("v"+fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	err = tree.Insert(key2, val)
-	if err == nil {
-		t.Fatal("Expected error but got nil")
-	}
+	for i, key := range keys {
+		res, err := tree.Find(key)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	if len(key1) != tree.keySize {
-		t.Fatalf("Expected keySize to be %d but got %d", len(key1), tree.keySize)
+		if !reflect.DeepEqual(res, []byte("v"+fmt.Sprint(i))) {
+			t.Fatalf("Expected %s but got %s", "v"+fmt.Sprint(i), res)
+		}
 	}
 }
 
@@ -498,6 +504,417 @@ func TestDeleteRandom(t *testing.T) {
 	}
 }
 
+func TestSeparator(t *testing.T) {
+	tests := []struct{ left, right, expected string }{
+		{"apple", "banana", "b"},
+		{"tenant/1/a", "tenant/2/a", "tenant/2"},
+		{"abc", "abcd", "abcd"},
+		{"", "a", "a"},
+	}
+
+	for _, test := range tests {
+		res := separator([]byte(test.left), []byte(test.right))
+		if !reflect.DeepEqual(res, []byte(test.expected)) {
+			t.Fatalf("expected %q but got %q", test.expected, res)
+		}
+	}
+}
+
+func TestSuffixTruncation(t *testing.T) {
+	tree := NewTree()
+	keys, err := getRandomKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		err = tree.Insert(key, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Random keys differ within their first few bytes, so separators are much shorter.
+	var walk func(node *BTreeNode)
+	walk = func(node *BTreeNode) {
+		if node.IsLeaf {
+			return
+		}
+
+		for i := 0; i < node.Numkeys; i++ {
+			if len(node.Keys[i]) >= RAND_KEY_LEN {
+				t.Fatalf("expected a separator shorter than %d bytes but got %d", RAND_KEY_LEN, len(node.Keys[i]))
+			}
+		}
+
+		for i := 0; i <= node.Numkeys; i++ {
+			walk(node.Pointers[i].(*BTreeNode))
+		}
+	}
+	walk(tree.root)
+
+	for i, key := range keys {
+		if i%2 == 0 {
+			err = tree.Delete(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for i, key := range keys {
+		res, err := tree.Find(key)
+		if i%2 == 0 {
+			if err != KEY_NOT_FOUND_ERROR {
+				t.Fatalf("expected %v but got %v", KEY_NOT_FOUND_ERROR, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(res, key) {
+			t.Fatalf("expected %v but got %v", key, res)
+		}
+	}
+}
+
+func TestInvalidOrder(t *testing.T) {
+	tree, err := NewTreeWithOptions(Options{Order: 3})
+	if err != INVALID_ORDER_ERROR {
+		t.Fatalf("expected %v but got %v", INVALID_ORDER_ERROR, err)
+	}
+
+	if tree != nil {
+		t.Fatalf("expected nil but got %v", tree)
+	}
+}
+
+func TestCustomOrder(t *testing.T) {
+	for _, order := range []int{5, 8, 33} {
+		tree, err := NewTreeWithOptions(Options{Order: order})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := make([][]byte, 0, MULTIPLE_TEST_COUNT)
+		err = ascendingLoop(func(key, val []byte) error {
+			keys = append(keys, key)
+			return tree.Insert(key, val)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(tree.root.Keys) != order-1 {
+			t.Fatalf("expected root to hold %d keys but got %d", order-1, len(tree.root.Keys))
+		}
+
+		err = ascendingLoop(func(key, val []byte) error {
+			res, err := tree.Find(key)
+			if err != nil {
+				return err
+			}
+
+			if !reflect.DeepEqual(res, val) {
+				return errors.New(fmt.Sprintf("expected %v but got %v \n", val, res))
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mathRand.Shuffle(len(keys), func(i, j int) {
+			keys[i], keys[j] = keys[j], keys[i]
+		})
+
+		for _, key := range keys {
+			err = tree.Delete(key)
+			if err != nil {
+				t.Fatalf("Expected nil but got %v", err)
+			}
+		}
+
+		if tree.root != nil {
+			t.Fatalf("expected empty tree but got %v", tree.root)
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	tree := NewTree()
+	cursor := tree.Cursor()
+	if cursor.First() || cursor.Last() || cursor.Next() {
+		t.Fatal("expected an invalid cursor for an empty tree")
+	}
+
+	// Only even keys are inserted, so that odd keys can be seeked to between them.
+	for _, i := range mathRand.Perm(MULTIPLE_TEST_COUNT) {
+		err := tree.Insert(getPaddedKey("4", 2*i), []byte(toString(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	i := 0
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		if !reflect.DeepEqual(cursor.Key(), getPaddedKey("4", 2*i)) {
+			t.Fatalf("expected %s but got %s", getPaddedKey("4", 2*i), cursor.Key())
+		}
+
+		if !reflect.DeepEqual(cursor.Value(), []byte(toString(i))) {
+			t.Fatalf("expected %s but got %s", toString(i), cursor.Value())
+		}
+
+		i++
+	}
+
+	if i != MULTIPLE_TEST_COUNT {
+		t.Fatalf("expected %d entries but got %d", MULTIPLE_TEST_COUNT, i)
+	}
+
+	for ok := cursor.Last(); ok; ok = cursor.Prev() {
+		i--
+		if !reflect.DeepEqual(cursor.Key(), getPaddedKey("4", 2*i)) {
+			t.Fatalf("expected %s but got %s", getPaddedKey("4", 2*i), cursor.Key())
+		}
+	}
+
+	if i != 0 {
+		t.Fatalf("expected to walk back to the first entry but stopped %d entries before it", i)
+	}
+
+	if !cursor.Seek(getPaddedKey("4", 11)) || !reflect.DeepEqual(cursor.Key(), getPaddedKey("4", 12)) {
+		t.Fatalf("expected %s but got %s", getPaddedKey("4", 12), cursor.Key())
+	}
+
+	if !cursor.Prev() || !reflect.DeepEqual(cursor.Key(), getPaddedKey("4", 10)) {
+		t.Fatalf("expected %s but got %s", getPaddedKey("4", 10), cursor.Key())
+	}
+
+	if cursor.Seek(getPaddedKey("4", 2*MULTIPLE_TEST_COUNT)) {
+		t.Fatalf("expected an invalid cursor but got %s", cursor.Key())
+	}
+
+	// The links between the leaves stay intact when leaves are merged.
+	for i := 1; i < MULTIPLE_TEST_COUNT; i += 2 {
+		err := tree.Delete(getPaddedKey("4", 2*i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	i = MULTIPLE_TEST_COUNT
+	for ok := cursor.Last(); ok; ok = cursor.Prev() {
+		i -= 2
+		if !reflect.DeepEqual(cursor.Key(), getPaddedKey("4", 2*i)) {
+			t.Fatalf("expected %s but got %s", getPaddedKey("4", 2*i), cursor.Key())
+		}
+	}
+
+	if i != 0 {
+		t.Fatalf("expected to walk back to the first entry but stopped %d entries before it", i/2)
+	}
+
+	// Deleting the entries while walking them doesn't skip any of them.
+	i = 0
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		if !reflect.DeepEqual(cursor.Key(), getPaddedKey("4", 2*i)) {
+			t.Fatalf("expected %s but got %s", getPaddedKey("4", 2*i), cursor.Key())
+		}
+
+		err := tree.Delete(cursor.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		i += 2
+	}
+
+	if i != MULTIPLE_TEST_COUNT || tree.root != nil {
+		t.Fatalf("expected to delete %d entries but deleted %d", MULTIPLE_TEST_COUNT/2, i/2)
+	}
+}
+
+func TestRange(t *testing.T) {
+	tree := NewTree()
+	for _, i := range mathRand.Perm(MULTIPLE_TEST_COUNT) {
+		err := tree.Insert(getPaddedKey("4", i), []byte(toString(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key := func(i int) []byte {
+		return getPaddedKey("4", i)
+	}
+
+	tests := []struct {
+		start, end  []byte
+		opts        RangeOptions
+		first, last int
+	}{
+		{nil, nil, RangeOptions{}, 0, MULTIPLE_TEST_COUNT - 1},
+		{key(10), key(20), RangeOptions{}, 10, 19},
+		{key(10), key(20), RangeOptions{IncludeEnd: true}, 10, 20},
+		{key(10), key(20), RangeOptions{ExcludeStart: true}, 11, 19},
+		{nil, key(20), RangeOptions{}, 0, 19},
+		{key(10), nil, RangeOptions{}, 10, MULTIPLE_TEST_COUNT - 1},
+		{[]byte("0010.5"), []byte("0019.5"), RangeOptions{}, 11, 19},
+		{key(MULTIPLE_TEST_COUNT - 5), key(MULTIPLE_TEST_COUNT + 5), RangeOptions{}, MULTIPLE_TEST_COUNT - 5, MULTIPLE_TEST_COUNT - 1},
+	}
+
+	for _, test := range tests {
+		i := test.first
+		tree.RangeWithOptions(test.start, test.end, test.opts, func(k, v []byte) bool {
+			if !reflect.DeepEqual(k, key(i)) || !reflect.DeepEqual(v, []byte(toString(i))) {
+				t.Fatalf("expected %s but got %s", key(i), k)
+			}
+
+			i++
+			return true
+		})
+
+		if i != test.last+1 {
+			t.Fatalf("expected the scan to end after %s but it ended after %s", key(test.last), key(i-1))
+		}
+
+		tree.ReverseRangeWithOptions(test.start, test.end, test.opts, func(k, v []byte) bool {
+			i--
+			if !reflect.DeepEqual(k, key(i)) || !reflect.DeepEqual(v, []byte(toString(i))) {
+				t.Fatalf("expected %s but got %s", key(i), k)
+			}
+
+			return true
+		})
+
+		if i != test.first {
+			t.Fatalf("expected the reverse scan to end at %s but it ended at %s", key(test.first), key(i))
+		}
+	}
+
+	// Scans stop once fn returns false.
+	keys := [][]byte{}
+	tree.RangeFunc(key(10), nil, func(k, v []byte) bool {
+		keys = append(keys, k)
+		return len(keys) < 3
+	})
+
+	if !reflect.DeepEqual(keys, [][]byte{key(10), key(11), key(12)}) {
+		t.Fatalf("expected 3 keys starting at %s but got %s", key(10), keys)
+	}
+
+	keys = [][]byte{}
+	tree.ReverseRange(nil, key(10), func(k, v []byte) bool {
+		keys = append(keys, k)
+		return len(keys) < 3
+	})
+
+	if !reflect.DeepEqual(keys, [][]byte{key(9), key(8), key(7)}) {
+		t.Fatalf("expected 3 keys before %s but got %s", key(10), keys)
+	}
+}
+
+func TestScanPrefix(t *testing.T) {
+	tree := NewTree()
+	tenants := []string{"a", "b", "bb", "c"}
+	for _, i := range mathRand.Perm(MULTIPLE_TEST_COUNT) {
+		for _, tenant := range tenants {
+			err := tree.Insert([]byte(fmt.Sprintf("%s/entity/%04d", tenant, i)), []byte(tenant))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, tenant := range tenants {
+		i := 0
+		tree.ScanPrefix([]byte(tenant+"/"), func(k, v []byte) bool {
+			expected := []byte(fmt.Sprintf("%s/entity/%04d", tenant, i))
+			if !reflect.DeepEqual(k, expected) || !reflect.DeepEqual(v, []byte(tenant)) {
+				t.Fatalf("expected %s but got %s", expected, k)
+			}
+
+			i++
+			return true
+		})
+
+		if i != MULTIPLE_TEST_COUNT {
+			t.Fatalf("expected %d keys for %s but got %d", MULTIPLE_TEST_COUNT, tenant, i)
+		}
+	}
+
+	tree.ScanPrefix([]byte("d/"), func(k, v []byte) bool {
+		t.Fatalf("unexpected key %s", k)
+		return true
+	})
+}
+
+func TestIterators(t *testing.T) {
+	tree := NewTree()
+	for _, i := range mathRand.Perm(MULTIPLE_TEST_COUNT) {
+		err := tree.Insert(getPaddedKey("4", i), []byte(toString(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	i := 0
+	for k, v := range tree.All() {
+		if !reflect.DeepEqual(k, getPaddedKey("4", i)) || !reflect.DeepEqual(v, []byte(toString(i))) {
+			t.Fatalf("expected %s but got %s", getPaddedKey("4", i), k)
+		}
+
+		i++
+	}
+
+	if i != MULTIPLE_TEST_COUNT {
+		t.Fatalf("expected %d keys but got %d", MULTIPLE_TEST_COUNT, i)
+	}
+
+	for k := range tree.Backward() {
+		i--
+		if !reflect.DeepEqual(k, getPaddedKey("4", i)) {
+			t.Fatalf("expected %s but got %s", getPaddedKey("4", i), k)
+		}
+	}
+
+	if i != 0 {
+		t.Fatalf("expected the backward iteration to end at 0 but it ended at %d", i)
+	}
+
+	i = 10
+	for k := range tree.Range(getPaddedKey("4", 10), getPaddedKey("4", 20)) {
+		if !reflect.DeepEqual(k, getPaddedKey("4", i)) {
+			t.Fatalf("expected %s but got %s", getPaddedKey("4", i), k)
+		}
+
+		i++
+	}
+
+	if i != 20 {
+		t.Fatalf("expected the range to end at 20 but it ended at %d", i)
+	}
+
+	// Breaking out of the loop stops the iteration.
+	keys := [][]byte{}
+	for k := range tree.All() {
+		keys = append(keys, k)
+		if len(keys) == 3 {
+			break
+		}
+	}
+
+	if !reflect.DeepEqual(keys, [][]byte{getPaddedKey("4", 0), getPaddedKey("4", 1), getPaddedKey("4", 2)}) {
+		t.Fatalf("expected the first 3 keys but got %s", keys)
+	}
+}
+
 func toString(i int) string {
 	return fmt.Sprint(i)
 }